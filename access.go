@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+const (
+	openAccess      = "open"
+	allowlistAccess = "allowlist"
+	inviteAccess    = "invite"
+
+	inviteCodeBytes = 6
+
+	refusalMessage       = "Sorry, this bot is private."
+	inviteRefusalMessage = "Sorry, this bot is invite only. If you have an invite code, send /start *code*."
+	invalidInviteMessage = "Sorry, this invite code is not valid or has been used already."
+	welcomeMessage       = "Welcome! Send /help to see what I can do."
+)
+
+// The users who have been told they can't use the bot. They are told only
+// once per run, after that they are ignored. This is kept in memory, nothing
+// about them goes to the database.
+var refusedUsers sync.Map
+
+// Checks if the bot should talk to the user at all and if it's available at
+// the moment. Returns false when the update should not be handled any further.
+func (c context) checkAccess() (bool, error) {
+	if c.message.From == nil {
+		return false, nil
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	userID := c.message.From.ID
+
+	blocked := false
+	err := sqlitex.Exec(
+		connection,
+		"SELECT 1 FROM blocked WHERE user = ?;",
+		func(s *sqlite.Stmt) error {
+			blocked = true
+			return nil
+		},
+		userID)
+
+	if err != nil {
+		return false, err
+	}
+
+	// Not a word to the blocked ones
+	if blocked {
+		c.logger().Debug("Ignored the blocked user")
+		return false, nil
+	}
+
+	if c.isAdmin() {
+		return true, nil
+	}
+
+	allowed, err := c.isAllowed(connection)
+	if err != nil {
+		return false, err
+	}
+
+	if !allowed {
+		return false, c.refuse(connection)
+	}
+
+	maintenance, err := getState(connection, maintenanceKey)
+	if err != nil {
+		return false, err
+	}
+
+	if maintenance != 0 {
+		return false, c.notify(maintenanceMessage, "")
+	}
+
+	return true, nil
+}
+
+// Tells the user why nothing happens. Only the messages get a reply, the
+// button presses get it as a popup and the inline queries get no results.
+// The inline queries come with every key press, a message for each would be
+// a flood. There's nowhere to answer a chosen inline result.
+func (c context) notify(text string, format string) error {
+	switch {
+	case c.callback != nil:
+		return c.answerCallback(text)
+	case c.inlineQuery != nil:
+		return c.answerInlineResults([]interface{}{})
+	case c.chosenResult != nil:
+		return nil
+	}
+
+	return c.sendResponse(text, format)
+}
+
+func (c context) isAllowed(connection *sqlite.Conn) (bool, error) {
+	if c.config.Access.Mode == openAccess {
+		return true, nil
+	}
+
+	userID := c.message.From.ID
+	for _, id := range c.config.Access.Allowlist {
+		if id == userID {
+			return true, nil
+		}
+	}
+
+	allowed := false
+	err := sqlitex.Exec(
+		connection,
+		"SELECT 1 FROM allowed WHERE user = ?;",
+		func(s *sqlite.Stmt) error {
+			allowed = true
+			return nil
+		},
+		userID)
+
+	return allowed, err
+}
+
+// Lets the user in with "/start code" in the invite mode, otherwise explains
+// once why the bot is not talking
+func (c context) refuse(connection *sqlite.Conn) error {
+	userID := c.message.From.ID
+
+	if c.config.Access.Mode == inviteAccess && c.message.IsCommand() && c.message.Command() == "start" {
+		code := strings.TrimSpace(c.message.CommandArguments())
+		if code != "" {
+			redeemed, err := redeemInvite(connection, code, userID, c.now().Unix())
+			if err != nil {
+				return err
+			}
+
+			if !redeemed {
+				return c.sendText(invalidInviteMessage)
+			}
+
+			c.logger().Info("User joined with an invite code")
+			refusedUsers.Delete(userID)
+
+			return c.sendText(welcomeMessage)
+		}
+	}
+
+	if _, refused := refusedUsers.LoadOrStore(userID, true); refused {
+		c.logger().Debug("Ignored the unauthorized user")
+		return nil
+	}
+
+	if c.config.Access.Mode == inviteAccess {
+		return c.notify(inviteRefusalMessage, "Markdown")
+	}
+
+	return c.notify(refusalMessage, "")
+}
+
+// Marks the invite as used by the user and lets the user in. Returns false
+// when there's no such code or it's been used.
+func redeemInvite(connection *sqlite.Conn, code string, userID int, now int64) (redeemed bool, err error) {
+	defer sqlitex.Save(connection)(&err)
+
+	err = sqlitex.Exec(
+		connection,
+		"UPDATE invites SET user = ? WHERE code = ? AND user IS NULL;",
+		nil,
+		userID,
+		code)
+
+	if err != nil || connection.Changes() == 0 {
+		return false, err
+	}
+
+	err = allowUser(connection, userID, code, now)
+	return err == nil, err
+}
+
+func allowUser(connection *sqlite.Conn, userID int, code string, now int64) error {
+	return sqlitex.Exec(
+		connection,
+		"INSERT OR REPLACE INTO allowed (user, code, date) VALUES (?, ?, ?);",
+		nil,
+		userID,
+		code,
+		now)
+}
+
+func (c context) adminAllow(args string, allow bool) error {
+	userID, err := strconv.Atoi(strings.TrimSpace(args))
+	if err != nil {
+		return c.sendMarkdown("Please provide the user ID: /admin allow *userID*")
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	if allow {
+		err = allowUser(connection, userID, "", c.now().Unix())
+	} else {
+		err = sqlitex.Exec(connection, "DELETE FROM allowed WHERE user = ?;", nil, userID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if allow {
+		refusedUsers.Delete(userID)
+		return c.sendText(fmt.Sprintf("User %d is allowed", userID))
+	}
+
+	return c.sendText(fmt.Sprintf("User %d is not allowed anymore", userID))
+}
+
+func (c context) adminInvite() error {
+	buffer := make([]byte, inviteCodeBytes)
+	if _, err := rand.Read(buffer); err != nil {
+		return err
+	}
+
+	code := hex.EncodeToString(buffer)
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	err := sqlitex.Exec(
+		connection,
+		"INSERT INTO invites (code, admin, date) VALUES (?, ?, ?);",
+		nil,
+		code,
+		c.message.From.ID,
+		c.now().Unix())
+
+	if err != nil {
+		return err
+	}
+
+	response := fmt.Sprintf("Invite code: %s\nThe user should send /start %s", code, code)
+	if c.bot != nil {
+		response += fmt.Sprintf("\nOr open https://t.me/%s?start=%s", c.bot.Self.UserName, code)
+	}
+
+	if c.config.Access.Mode != inviteAccess {
+		response += fmt.Sprintf("\nNote that the access mode is '%s', the code only works in the '%s' mode", c.config.Access.Mode, inviteAccess)
+	}
+
+	return c.sendText(response)
+}
@@ -24,7 +24,8 @@ var activityChartDefaultColors = []drawing.Color{
 var activityChartDayLabels = []string{"Mon", "", "Wed", "", "Fri", "", "Sun"}
 var activityChartMonthLabels = []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
 
-// ActivityChart draws a daily activity chart for one year
+// ActivityChart draws a daily activity chart for one year. With custom column
+// and row labels it draws any grid with 7 rows, like a weekly punch card.
 type ActivityChart struct {
 	Title      string
 	TitleStyle chart.Style
@@ -53,6 +54,11 @@ type ActivityChart struct {
 	CurrentMonth int // 0-11
 	RightToLeft  bool
 
+	// Optional per column labels. When empty the month labels are used.
+	ColumnLabels []string
+	// Optional per row labels. When empty the day labels are used.
+	RowLabels []string
+
 	// Layout info and other cached valued (all updated in `layout()`)
 	titleX      int
 	titleY      int
@@ -117,6 +123,14 @@ func (ac ActivityChart) GetBackgroundStyle() chart.Style {
 	return ac.Background.InheritFrom(ac.styleDefaultsBackground())
 }
 
+// GetRowLabels returns the row labels or the default day labels
+func (ac ActivityChart) GetRowLabels() []string {
+	if len(ac.RowLabels) == 0 {
+		return activityChartDayLabels
+	}
+	return ac.RowLabels
+}
+
 // GetFont returns the chart text font or the default value
 func (ac ActivityChart) GetFont() *truetype.Font {
 	if ac.Font == nil {
@@ -152,10 +166,6 @@ func (ac ActivityChart) Render(rp chart.RendererProvider, w io.Writer) error {
 
 	r.SetDPI(ac.GetDPI())
 
-	// TODO: Remove this
-	ac.Title = fmt.Sprintf("%d x %d @ %d dpi", ac.GetWidth(), ac.GetHeight(), int(ac.GetDPI()))
-	ac.TitleStyle.Show = true
-
 	// Draw
 	ac.layout(r)
 
@@ -282,6 +292,11 @@ func (ac ActivityChart) drawXAxis(r chart.Renderer) {
 	style := ac.YAxis.InheritFrom(ac.styleDefaultsAxes())
 	style.GetTextOptions().WriteToRenderer(r)
 
+	if len(ac.ColumnLabels) > 0 {
+		ac.drawColumnLabels(r, style)
+		return
+	}
+
 	dotSize := ac.GetDotSize()
 	dotSpacing := ac.GetDotSpacing()
 
@@ -308,6 +323,27 @@ func (ac ActivityChart) drawXAxis(r chart.Renderer) {
 	}
 }
 
+// Draws one label centered above each column
+func (ac ActivityChart) drawColumnLabels(r chart.Renderer, style chart.Style) {
+	size := ac.GetDotSize()
+	spacing := ac.GetDotSpacing()
+
+	for i, label := range ac.ColumnLabels {
+		if len(label) == 0 || i >= ac.numWeeks {
+			continue
+		}
+
+		column := i
+		if ac.RightToLeft {
+			column = ac.numWeeks - 1 - column
+		}
+
+		x := ac.chartX + column*(size+spacing) + size/2
+		y := ac.chartY - size
+		chart.Draw.Text(r, label, x-r.MeasureText(label).Width()/2, y, style)
+	}
+}
+
 func (ac ActivityChart) drawYAxis(r chart.Renderer) {
 	if !ac.YAxis.Show {
 		return
@@ -319,10 +355,11 @@ func (ac ActivityChart) drawYAxis(r chart.Renderer) {
 	dotSize := ac.GetDotSize()
 	dotSpacing := ac.GetDotSpacing()
 
-	boxes := measureStrings(r, activityChartDayLabels)
+	labels := ac.GetRowLabels()
+	boxes := measureStrings(r, labels)
 	maxWidth, _ := getMaxWidthHeight(boxes)
 
-	for i, label := range activityChartDayLabels {
+	for i, label := range labels {
 		if len(label) == 0 {
 			continue
 		}
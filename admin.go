@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	maintenanceKey = "maintenance"
+
+	// Telegram allows about 30 messages a second to the different chats, so
+	// leave some room for the regular replies
+	broadcastInterval = time.Second / 20
+
+	maintenanceMessage = "The bot is under maintenance at the moment. Please try again a bit later."
+
+	// Everyone who ever logged anything. The groups have the negative IDs, the
+	// members of the groups and the trackers are the authors.
+	knownUsersQuery = "SELECT COALESCE(author, user) user FROM events WHERE COALESCE(author, user) > 0 " +
+		"UNION SELECT user FROM tracker_members"
+)
+
+func (c context) isAdmin() bool {
+	return c.message.From != nil && isAdminID(c.config, c.message.From.ID)
+}
+
+func isAdminID(config Config, userID int) bool {
+	for _, id := range config.Admins {
+		if id == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The admin commands are invisible to everyone else
+func (c context) admin(args string) error {
+	action, rest := splitFirstWord(args)
+	action = strings.ToLower(action)
+
+	if err := c.audit(action, rest); err != nil {
+		return err
+	}
+
+	switch action {
+	case "stats":
+		return c.adminStats()
+	case "broadcast":
+		return c.adminBroadcast(rest)
+	case "block":
+		return c.adminBlock(rest, true)
+	case "unblock":
+		return c.adminBlock(rest, false)
+	case "export":
+		return c.adminExport(rest)
+	case "maintenance":
+		return c.adminMaintenance(rest)
+	case "allow":
+		return c.adminAllow(rest, true)
+	case "disallow":
+		return c.adminAllow(rest, false)
+	case "invite":
+		return c.adminInvite()
+	case "backup":
+		return c.adminBackup()
+	default:
+		return c.sendMarkdown(`
+/admin stats - users, events and the database size
+/admin broadcast *text* - send the text to every user
+/admin block *userID* - ignore everything from the user
+/admin unblock *userID* - stop ignoring the user
+/admin export *userID* - full JSON dump of the user data
+/admin maintenance *[on|off]* - reject all the commands from the non admins
+/admin allow *userID* - let the user in when the access is limited
+/admin disallow *userID* - take the access away
+/admin invite - new single use invite code
+/admin backup - back up the database now and check the copy
+`)
+	}
+}
+
+// Every admin action goes to the audit table, even the failed ones
+func (c context) audit(action string, args string) error {
+	// The broadcast text could be long and is already in every chat, the hash
+	// is enough to tell which one it was
+	if action == "broadcast" {
+		args = fmt.Sprintf("%d bytes, sha256 %x", len(args), sha256.Sum256([]byte(args)))
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	return sqlitex.Exec(
+		connection,
+		"INSERT INTO audit (admin, action, args, date) VALUES (?, ?, ?, ?);",
+		nil,
+		c.message.From.ID,
+		action,
+		args,
+		c.now().Unix())
+}
+
+func (c context) adminStats() error {
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	var users, events, blocked, pageCount, pageSize int64
+	queries := map[string]*int64{
+		"SELECT COUNT(*) FROM (" + knownUsersQuery + ");": &users,
+		"SELECT COUNT(*) FROM events;":                    &events,
+		"SELECT COUNT(*) FROM blocked;":                   &blocked,
+		"PRAGMA page_count;":                              &pageCount,
+		"PRAGMA page_size;":                               &pageSize,
+	}
+
+	for query, value := range queries {
+		err := sqlitex.Exec(connection, query, func(s *sqlite.Stmt) error {
+			*value = s.ColumnInt64(0)
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	maintenance, err := getState(connection, maintenanceKey)
+	if err != nil {
+		return err
+	}
+
+	return c.sendText(fmt.Sprintf(
+		"Users: %d\nEvents: %d\nBlocked: %d\nDatabase: %.1f MB\nMaintenance: %s",
+		users,
+		events,
+		blocked,
+		float64(pageCount*pageSize)/(1024*1024),
+		onOff(maintenance != 0)))
+}
+
+// Sends the text to everyone who ever logged anything, slowly enough not to
+// hit the Telegram limits. It takes a while, so it runs in the background not
+// to hold up the other users on this worker, and the admin gets the result
+// when it's done.
+func (c context) adminBroadcast(text string) error {
+	if text == "" {
+		return c.sendMarkdown("Please provide the text: /admin broadcast *text*")
+	}
+
+	users, err := c.getBroadcastUsers()
+	if err != nil {
+		return err
+	}
+
+	started := c.jobs.start("broadcast", func(quit <-chan struct{}) error {
+		ticker := time.NewTicker(broadcastInterval)
+		defer ticker.Stop()
+
+		sent := 0
+		for i, id := range users {
+			select {
+			case <-ticker.C:
+			case <-quit:
+				return c.sendText(fmt.Sprintf(
+					"The bot is shutting down, the broadcast is stopped. Sent to %d of %d users, %d are left",
+					sent,
+					len(users),
+					len(users)-i))
+			}
+
+			// The ones who blocked the bot are expected to fail
+			if err := c.send(id, tgbotapi.NewMessage(id, text)); err != nil {
+				c.logger().Warn("Failed to broadcast", "chat_id", id, "error", err)
+				continue
+			}
+
+			sent++
+		}
+
+		return c.sendText(fmt.Sprintf("The broadcast is done, sent to %d of %d users", sent, len(users)))
+	})
+
+	if !started {
+		return c.sendText("The bot is shutting down, please try again after the restart")
+	}
+
+	return c.sendText(fmt.Sprintf(
+		"Broadcasting to %d users, it takes about %s. You'll get a message when it's done.",
+		len(users),
+		(time.Duration(len(users)) * broadcastInterval).Round(time.Second)))
+}
+
+func (c context) getBroadcastUsers() ([]int64, error) {
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	users := []int64{}
+	err := sqlitex.Exec(
+		connection,
+		// Only the users, not the shared groups or trackers
+		"SELECT user FROM ("+knownUsersQuery+") WHERE user NOT IN (SELECT user FROM blocked) ORDER BY user;",
+		func(s *sqlite.Stmt) error {
+			users = append(users, s.ColumnInt64(0))
+			return nil
+		})
+
+	return users, err
+}
+
+func (c context) adminBlock(args string, block bool) error {
+	userID, err := strconv.Atoi(strings.TrimSpace(args))
+	if err != nil {
+		return c.sendMarkdown("Please provide the user ID: /admin block *userID*")
+	}
+
+	// The blocked ones are ignored before anything else, there would be no
+	// way to unblock
+	if block && isAdminID(c.config, userID) {
+		return c.sendText(fmt.Sprintf("User %d is an admin and can't be blocked", userID))
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	if block {
+		err = sqlitex.Exec(
+			connection,
+			"INSERT OR REPLACE INTO blocked (user, date) VALUES (?, ?);",
+			nil,
+			userID,
+			c.now().Unix())
+	} else {
+		err = sqlitex.Exec(connection, "DELETE FROM blocked WHERE user = ?;", nil, userID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if block {
+		return c.sendText(fmt.Sprintf("User %d is blocked", userID))
+	}
+
+	return c.sendText(fmt.Sprintf("User %d is unblocked", userID))
+}
+
+func (c context) adminExport(args string) error {
+	userID, err := strconv.Atoi(strings.TrimSpace(args))
+	if err != nil {
+		return c.sendMarkdown("Please provide the user ID: /admin export *userID*")
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	return c.sendFileStream(fmt.Sprintf("user-%d.json", userID), func(w io.Writer) error {
+		return writeJSONDump(w, connection, userID, c.now())
+	})
+}
+
+// Without the arguments just reports the current mode
+func (c context) adminMaintenance(args string) error {
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	switch strings.ToLower(strings.TrimSpace(args)) {
+	case "on":
+		if err := setState(connection, maintenanceKey, 1); err != nil {
+			return err
+		}
+	case "off":
+		if err := setState(connection, maintenanceKey, 0); err != nil {
+			return err
+		}
+	case "":
+	default:
+		return c.sendMarkdown("Please use: /admin maintenance *[on|off]*")
+	}
+
+	maintenance, err := getState(connection, maintenanceKey)
+	if err != nil {
+		return err
+	}
+
+	return c.sendText("Maintenance mode is " + onOff(maintenance != 0))
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+
+	return "off"
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetBroadcastUsers(t *testing.T) {
+	// Personal, in a shared group, in a tracker only and blocked
+	db := openTestDB(t, testData{
+		trackers: []testTracker{{7, "walk", []testMember{{3, viewerRole}}}},
+		events: []testEvent{
+			{user: 1, author: 1, name: "coffee", date: 1},
+			{user: -100, author: 2, name: "pizza", date: 2},
+			{user: 4, author: 4, name: "spam", date: 4},
+		},
+		blocked: []int{4},
+	})
+
+	users, err := context{db: db}.getBroadcastUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int64{1, 2, 3}; !reflect.DeepEqual(users, want) {
+		t.Errorf("got %v, want %v", users, want)
+	}
+}
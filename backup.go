@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+const (
+	// The job checks every hour whether the last backup is a day old, so a
+	// restart doesn't skip or repeat a day
+	backupCheckInterval = time.Hour
+	backupInterval      = 24 * time.Hour
+
+	// The newest backup of every day is kept for a week and the newest of
+	// every week for 8 weeks
+	dailyBackupDays  = 7
+	weeklyBackupDays = 8 * daysPerWeek
+
+	backupPrefix     = "since-"
+	backupExtension  = ".db"
+	backupTimeLayout = "20060102-150405"
+)
+
+type backupResult struct {
+	path      string
+	size      int64
+	integrity string
+	duration  time.Duration
+}
+
+// Copies the database with the SQLite online backup API. The bot keeps
+// working meanwhile, the copy is consistent. It's written to a temporary file
+// first, so a half written backup never looks like a real one.
+func backupDB(db *sqlitex.Pool, dir string, now time.Time) (backupResult, error) {
+	started := time.Now()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return backupResult{}, err
+	}
+
+	path := filepath.Join(dir, backupPrefix+now.UTC().Format(backupTimeLayout)+backupExtension)
+	temporary := path + ".tmp"
+
+	integrity, err := copyDB(db, temporary)
+	if err != nil {
+		os.Remove(temporary)
+		return backupResult{}, err
+	}
+
+	if err := os.Rename(temporary, path); err != nil {
+		os.Remove(temporary)
+		return backupResult{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return backupResult{}, err
+	}
+
+	return backupResult{path: path, size: info.Size(), integrity: integrity, duration: time.Since(started)}, nil
+}
+
+// Returns the integrity check result of the copy, "ok" when it's fine
+func copyDB(db *sqlitex.Pool, path string) (string, error) {
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	backup, err := connection.BackupToDB("", path)
+	if err != nil {
+		return "", err
+	}
+	defer backup.Close()
+
+	// One file without the WAL next to it
+	if err := sqlitex.ExecTransient(backup, "PRAGMA journal_mode = DELETE;", nil); err != nil {
+		return "", err
+	}
+
+	problems := []string{}
+	err = sqlitex.ExecTransient(backup, "PRAGMA integrity_check;", func(s *sqlite.Stmt) error {
+		problems = append(problems, s.ColumnText(0))
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(problems, "\n"), nil
+}
+
+// The backups in the directory by the time in the name, the newest first.
+// Everything else in there is left alone.
+func listBackups(dir string) ([]string, map[string]time.Time, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := []string{}
+	times := map[string]time.Time{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupExtension) {
+			continue
+		}
+
+		t, err := time.Parse(backupTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupExtension))
+		if err != nil {
+			continue
+		}
+
+		names = append(names, name)
+		times[name] = t
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return times[names[i]].After(times[names[j]])
+	})
+
+	return names, times, nil
+}
+
+// The backups not needed anymore: everything but the newest of every day for
+// the last week and the newest of every week for the last 8 weeks
+func expiredBackups(names []string, times map[string]time.Time, now time.Time) []string {
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	expired := []string{}
+
+	for _, name := range names {
+		t := times[name]
+		age := now.Sub(t)
+		keep := false
+
+		day := t.Format("2006-01-02")
+		if age < dailyBackupDays*24*time.Hour && !days[day] {
+			days[day] = true
+			keep = true
+		}
+
+		year, number := t.ISOWeek()
+		week := fmt.Sprintf("%d-%d", year, number)
+		if age < weeklyBackupDays*24*time.Hour && !weeks[week] {
+			weeks[week] = true
+			keep = true
+		}
+
+		if !keep {
+			expired = append(expired, name)
+		}
+	}
+
+	return expired
+}
+
+func pruneBackups(dir string, now time.Time) error {
+	names, times, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range expiredBackups(names, times, now) {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+
+		slog.Info("Old backup deleted", "file", name)
+	}
+
+	return nil
+}
+
+// Backs up the database when the last backup is a day old and drops the
+// ones that are not needed anymore
+func scheduledBackup(db *sqlitex.Pool, dir string, now time.Time) error {
+	names, times, err := listBackups(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(names) > 0 && now.Sub(times[names[0]]) < backupInterval {
+		return nil
+	}
+
+	result, err := backupDB(db, dir, now)
+	if err != nil {
+		return err
+	}
+
+	if result.integrity != "ok" {
+		return fmt.Errorf("Backup %s failed the integrity check: %s", result.path, result.integrity)
+	}
+
+	slog.Info("Database backed up", "file", result.path, "size", result.size, "duration", result.duration)
+
+	return pruneBackups(dir, now)
+}
+
+// Backs up right away, the retention applies as usual
+func (c context) adminBackup() error {
+	dir := c.config.Backup.Dir
+	if dir == "" {
+		return c.sendText("The backups are off, set the backup directory in the config")
+	}
+
+	now := time.Now()
+	result, err := backupDB(c.db, dir, now)
+	if err != nil {
+		return err
+	}
+
+	if err := pruneBackups(dir, now); err != nil {
+		return err
+	}
+
+	return c.sendText(fmt.Sprintf(
+		"Backup: %s\nSize: %.1f MB\nIntegrity check: %s\nTook: %s",
+		filepath.Base(result.path),
+		float64(result.size)/(1024*1024),
+		result.integrity,
+		result.duration.Round(time.Millisecond)))
+}
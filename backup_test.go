@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpiredBackups(t *testing.T) {
+	now := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+
+	// The newest first, like listBackups returns them
+	backups := []struct {
+		time    time.Time
+		expired bool
+	}{
+		{time.Date(2026, time.October, 18, 3, 0, 0, 0, time.UTC), false},
+		// Not the newest of the day
+		{time.Date(2026, time.October, 18, 1, 0, 0, 0, time.UTC), true},
+		{time.Date(2026, time.October, 17, 3, 0, 0, 0, time.UTC), false},
+		{time.Date(2026, time.October, 12, 3, 0, 0, 0, time.UTC), false},
+		// Over a week old, the newest of the previous week
+		{time.Date(2026, time.October, 10, 3, 0, 0, 0, time.UTC), false},
+		{time.Date(2026, time.October, 9, 3, 0, 0, 0, time.UTC), true},
+		// Almost 8 weeks old
+		{time.Date(2026, time.August, 24, 3, 0, 0, 0, time.UTC), false},
+		// Over 8 weeks old
+		{time.Date(2026, time.August, 22, 3, 0, 0, 0, time.UTC), true},
+	}
+
+	names := []string{}
+	times := map[string]time.Time{}
+	want := []string{}
+	for _, b := range backups {
+		name := backupPrefix + b.time.Format(backupTimeLayout) + backupExtension
+		names = append(names, name)
+		times[name] = b.time
+		if b.expired {
+			want = append(want, name)
+		}
+	}
+
+	if expired := expiredBackups(names, times, now); !reflect.DeepEqual(expired, want) {
+		t.Errorf("got %v, want %v", expired, want)
+	}
+}
+
+func TestScheduledBackup(t *testing.T) {
+	db := openTestDB(t, testData{events: []testEvent{{user: 1, author: 1, name: "coffee", date: 1}}})
+	dir := t.TempDir()
+	now := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+
+	// An expired one and something else that is not a backup
+	old := backupPrefix + now.AddDate(0, -6, 0).Format(backupTimeLayout) + backupExtension
+	for _, name := range []string{old, "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first one backs up, the second one is too early
+	for _, at := range []time.Time{now, now.Add(backupInterval / 2)} {
+		if err := scheduledBackup(db, dir, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, _, err := listBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{backupPrefix + now.Format(backupTimeLayout) + backupExtension}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Error("the other files should be left alone")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	// Telegram limits
+	maxCallbackDataLength = 64
+	maxCallbackTextLength = 200
+
+	inlineKeyboardColumns = 2
+
+	addCallbackPrefix = "add:"
+)
+
+// The updates without a message are handled as if the user sent one to the
+// private chat with the bot right now
+func userMessage(from *tgbotapi.User) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		From: from,
+		Date: int(time.Now().Unix()),
+		Chat: &tgbotapi.Chat{ID: int64(from.ID), Type: "private"},
+	}
+}
+
+// The button presses go to the chat with the keyboard
+func callbackMessage(query *tgbotapi.CallbackQuery) *tgbotapi.Message {
+	message := userMessage(query.From)
+
+	// The keyboard message, it's gone after 48 hours or when it's inline
+	if query.Message != nil {
+		message.MessageID = query.Message.MessageID
+		message.Chat = query.Message.Chat
+	}
+
+	return message
+}
+
+// What the user sent or pressed, only for the logs
+func updateText(update tgbotapi.Update) string {
+	if update.CallbackQuery != nil {
+		return update.CallbackQuery.Data
+	}
+
+	if update.InlineQuery != nil {
+		return update.InlineQuery.Query
+	}
+
+	if update.ChosenInlineResult != nil {
+		return update.ChosenInlineResult.Query
+	}
+
+	if update.Message != nil {
+		return update.Message.Text
+	}
+
+	return ""
+}
+
+// Every button has its action in the data, like "add:123"
+func (c context) handleCallback() error {
+	data := c.callback.Data
+
+	switch {
+	case strings.HasPrefix(data, addCallbackPrefix):
+		return c.quickAdd(strings.TrimPrefix(data, addCallbackPrefix))
+	case strings.HasPrefix(data, sinceCallbackPrefix):
+		return c.sinceByID(strings.TrimPrefix(data, sinceCallbackPrefix))
+	case strings.HasPrefix(data, listCallbackPrefix):
+		return c.listPageCallback(strings.TrimPrefix(data, listCallbackPrefix))
+	case strings.HasPrefix(data, historyCallbackPrefix):
+		return c.historyPageCallback(strings.TrimPrefix(data, historyCallbackPrefix))
+	case strings.HasPrefix(data, forgetCallbackPrefix):
+		return c.forgetByID(strings.TrimPrefix(data, forgetCallbackPrefix))
+	case strings.HasPrefix(data, deleteMeCallbackPrefix):
+		return c.deleteMeByID(strings.TrimPrefix(data, deleteMeCallbackPrefix))
+	case data == cancelCallbackData:
+		return c.cancelConfirmation()
+	default:
+		return c.answerCallback("This button doesn't work anymore")
+	}
+}
+
+// Shows the toast at the top of the chat. Every press must be answered, or the
+// button keeps spinning.
+func (c context) answerCallback(text string) error {
+	c.logger().Debug("Answering the callback", "text", redact(text))
+
+	if debugChartEnabled || c.bot == nil {
+		return nil
+	}
+
+	if runes := []rune(text); len(runes) > maxCallbackTextLength {
+		text = string(runes[:maxCallbackTextLength])
+	}
+
+	_, err := c.bot.AnswerCallbackQuery(tgbotapi.NewCallback(c.callback.ID, text))
+	return err
+}
+
+func (c context) sendInlineKeyboard(text string, buttons []tgbotapi.InlineKeyboardButton) error {
+	c.logger().Debug("Sending an inline keyboard", "size", len(buttons))
+
+	if debugChartEnabled {
+		return saveRedPng()
+	}
+
+	message := tgbotapi.NewMessage(c.message.Chat.ID, text)
+	message.ReplyMarkup = newInlineKeyboard(buttons)
+
+	return c.send(c.message.Chat.ID, message)
+}
+
+// Replaces the text of the message with the pressed button, the keyboard goes
+// away too. Sends a new message when there's nothing to edit.
+func (c context) editText(text string) error {
+	return c.editTextWithKeyboard(text, nil)
+}
+
+// Same as editText, but the keyboard is replaced with a new one
+func (c context) editTextWithKeyboard(text string, keyboard *tgbotapi.InlineKeyboardMarkup) error {
+	if c.message.MessageID == 0 {
+		if keyboard != nil {
+			message := tgbotapi.NewMessage(c.message.Chat.ID, text)
+			message.ReplyMarkup = keyboard
+			return c.send(c.message.Chat.ID, message)
+		}
+
+		return c.sendText(text)
+	}
+
+	c.logger().Debug("Editing the message", "text", redact(text))
+
+	if debugChartEnabled {
+		return saveRedPng()
+	}
+
+	edit := tgbotapi.NewEditMessageText(c.message.Chat.ID, c.message.MessageID, text)
+	edit.ReplyMarkup = keyboard
+
+	return c.send(c.message.Chat.ID, edit)
+}
+
+func newInlineKeyboard(buttons []tgbotapi.InlineKeyboardButton) tgbotapi.InlineKeyboardMarkup {
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for i := 0; i < len(buttons); i += inlineKeyboardColumns {
+		end := i + inlineKeyboardColumns
+		if end > len(buttons) {
+			end = len(buttons)
+		}
+
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(buttons[i:end]...))
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// The names could be longer than the callback data allows, so the buttons
+// refer to an event with that name instead
+func addCallbackData(eventID int64) string {
+	return fmt.Sprintf("%s%d", addCallbackPrefix, eventID)
+}
+
+// Logs the event the pressed button refers to and tells the time since the
+// previous one in the toast
+func (c context) quickAdd(arg string) error {
+	eventID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return c.answerCallback("This button doesn't work anymore")
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	name, err := eventNameByID(connection, c.owner, eventID)
+	if err != nil {
+		return err
+	}
+
+	// Deleted or the button is someone else's
+	if name == "" {
+		return c.answerCallback("This event is gone")
+	}
+
+	readOnly, err := isReadOnly(connection, c.owner, name)
+	if err != nil {
+		return err
+	}
+
+	if readOnly {
+		return c.answerCallback(fmt.Sprintf(readOnlyMessage, name))
+	}
+
+	date := int64(c.message.Date)
+	response, err := buildSinceResponse(name, date, int64(c.owner), connection)
+	if err != nil {
+		return err
+	}
+
+	if err := c.storeEvent(connection, name, date); err != nil {
+		return err
+	}
+
+	return c.answerCallback("Logged! " + response)
+}
+
+// The name of the user's event or "" when there's no such event
+func eventNameByID(connection *sqlite.Conn, userID int, eventID int64) (string, error) {
+	name := ""
+	err := sqlitex.Exec(
+		connection,
+		"SELECT decrypt_name(name) name FROM events WHERE "+visibleEvents+" AND id = ?;",
+		func(s *sqlite.Stmt) error {
+			name = s.GetText("name")
+			return nil
+		},
+		userID,
+		eventID)
+
+	return name, err
+}
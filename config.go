@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultConfigPath  = "config.json"
+	defaultDBPath      = "./since.db"
+	defaultPollTimeout = 60
+
+	pollingMode = "polling"
+	webhookMode = "webhook"
+
+	// All the environment variables start with this
+	envPrefix = "SINCE_BOT_"
+
+	// The database connections taken besides the workers: the offset saver,
+	// the compaction, the backup and the health check
+	reservedConnections = 4
+)
+
+// Config holds all the settings. They are applied in layers, each one
+// overriding the previous: the defaults, the config file (JSON or YAML), the
+// SINCE_BOT_* environment variables and finally the command line flags.
+type Config struct {
+	Token string `json:"token" yaml:"token"`
+
+	// Telegram user IDs of the bot operators. They receive the internal error details.
+	Admins []int `json:"admins" yaml:"admins"`
+
+	// Number of the parallel update handlers, each one takes a DB connection
+	Workers int `json:"workers" yaml:"workers"`
+
+	Database DatabaseConfig `json:"database" yaml:"database"`
+	Telegram TelegramConfig `json:"telegram" yaml:"telegram"`
+	Charts   ChartsConfig   `json:"charts" yaml:"charts"`
+	Access   AccessConfig   `json:"access" yaml:"access"`
+
+	RateLimit RateLimitConfig `json:"rate_limit" yaml:"rate_limit"`
+	Metrics   MetricsConfig   `json:"metrics" yaml:"metrics"`
+	Log       LogConfig       `json:"log" yaml:"log"`
+	Backup    BackupConfig    `json:"backup" yaml:"backup"`
+}
+
+// DatabaseConfig is where the SQLite database lives. With the encryption key
+// the event names are encrypted, the existing ones at the next start.
+type DatabaseConfig struct {
+	Path     string `json:"path" yaml:"path"`
+	PoolSize int    `json:"pool_size" yaml:"pool_size"`
+
+	// 32 random bytes in base64, like `openssl rand -base64 32`
+	EncryptionKey string `json:"encryption_key" yaml:"encryption_key"`
+}
+
+// TelegramConfig is how the updates are received: by long polling or by
+// webhook. The webhook needs a public HTTPS URL Telegram can reach.
+type TelegramConfig struct {
+	Mode        string `json:"mode" yaml:"mode"`
+	PollTimeout int    `json:"poll_timeout" yaml:"poll_timeout"`
+
+	WebhookURL    string `json:"webhook_url" yaml:"webhook_url"`
+	WebhookListen string `json:"webhook_listen" yaml:"webhook_listen"`
+
+	// When empty the TLS is expected to be terminated by a proxy in front of the bot
+	WebhookCert string `json:"webhook_cert" yaml:"webhook_cert"`
+	WebhookKey  string `json:"webhook_key" yaml:"webhook_key"`
+}
+
+// ChartsConfig holds the default ranges and the limits of the chart commands
+type ChartsConfig struct {
+	MonthDays       int `json:"month_days" yaml:"month_days"`
+	YearWeeks       int `json:"year_weeks" yaml:"year_weeks"`
+	MaxDays         int `json:"max_days" yaml:"max_days"`
+	TopCount        int `json:"top_count" yaml:"top_count"`
+	MaxTopCount     int `json:"max_top_count" yaml:"max_top_count"`
+	MaxCompareCount int `json:"max_compare_count" yaml:"max_compare_count"`
+
+	// The days and the hours on the charts are in this time zone, like
+	// "Europe/Berlin". The server's local time zone when empty.
+	Timezone string `json:"timezone" yaml:"timezone"`
+
+	// Loaded from Timezone by loadConfig
+	timezone *time.Location
+}
+
+// AccessConfig is who can use the bot. In the "open" mode it's everyone, in
+// the "allowlist" mode only the listed users and the ones allowed by an admin,
+// in the "invite" mode also the ones who used an invite code.
+type AccessConfig struct {
+	Mode      string `json:"mode" yaml:"mode"`
+	Allowlist []int  `json:"allowlist" yaml:"allowlist"`
+}
+
+// RateLimitConfig is how many updates a user can send. Up to `burst` at once
+// and then `per_minute` on average. 0 per minute turns the limit off.
+type RateLimitConfig struct {
+	PerMinute int `json:"per_minute" yaml:"per_minute"`
+	Burst     int `json:"burst" yaml:"burst"`
+}
+
+// MetricsConfig is where /metrics and /healthz are served, like ":9090". The
+// server is off when it's empty.
+type MetricsConfig struct {
+	Listen string `json:"listen" yaml:"listen"`
+}
+
+// BackupConfig is where the daily database backups go. The backups are off
+// when it's empty.
+type BackupConfig struct {
+	Dir string `json:"dir" yaml:"dir"`
+}
+
+// LogConfig is how much goes to the logs and in what format: "logfmt" or
+// "json". The event names are hashed unless `show_user_texts` is set.
+type LogConfig struct {
+	Level         string `json:"level" yaml:"level"`
+	Format        string `json:"format" yaml:"format"`
+	ShowUserTexts bool   `json:"show_user_texts" yaml:"show_user_texts"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Workers: defaultWorkerCount,
+		Database: DatabaseConfig{
+			Path:     defaultDBPath,
+			PoolSize: dbPoolSize,
+		},
+		Telegram: TelegramConfig{
+			Mode:        pollingMode,
+			PollTimeout: defaultPollTimeout,
+		},
+		Charts: ChartsConfig{
+			MonthDays:       defaultMonthChartDays,
+			YearWeeks:       defaultYearChartWeeks,
+			MaxDays:         maxChartDays,
+			TopCount:        defaultTopCount,
+			MaxTopCount:     maxTopCount,
+			MaxCompareCount: maxCompareCount,
+		},
+		Access: AccessConfig{
+			Mode: openAccess,
+		},
+		RateLimit: RateLimitConfig{
+			PerMinute: defaultRateLimitPerMinute,
+			Burst:     defaultRateLimitBurst,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: logfmtLogFormat,
+		},
+	}
+}
+
+// Builds the config from all the layers and checks it. The config flags are
+// registered on the flag set, so the subcommands get them too.
+func loadConfig(flags *flag.FlagSet, args []string) (Config, error) {
+	config := defaultConfig()
+
+	path := flags.String("config", defaultConfigPath, "Config file, JSON or YAML")
+	token := flags.String("token", "", "Telegram bot token")
+	admins := flags.String("admins", "", "Comma separated admin user IDs")
+	workers := flags.Int("workers", 0, "Number of the update workers")
+	dbPath := flags.String("db", "", "Database file")
+	poolSize := flags.Int("pool-size", 0, "Number of the database connections")
+	mode := flags.String("mode", "", "How to receive the updates: polling or webhook")
+	webhookURL := flags.String("webhook-url", "", "Public URL of the webhook")
+	webhookListen := flags.String("webhook-listen", "", "Address to listen on for the webhook, like :8443")
+	access := flags.String("access", "", "Who can use the bot: open, allowlist or invite")
+	metricsListen := flags.String("metrics-listen", "", "Address to serve /metrics and /healthz on, like :9090")
+	logLevel := flags.String("log-level", "", "Log level: debug, info, warn or error")
+	logFormat := flags.String("log-format", "", "Log format: logfmt or json")
+	backupDir := flags.String("backup-dir", "", "Directory for the daily database backups")
+	timezone := flags.String("timezone", "", "Time zone of the charts, like Europe/Berlin")
+
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	// It's fine not to have the default config, everything could come from
+	// the environment. The one asked for explicitly must be there.
+	explicit := isFlagSet(flags, "config")
+	if explicit || fileExists(*path) {
+		if err := readConfigFile(*path, &config); err != nil {
+			return config, err
+		}
+	}
+
+	if err := applyEnv(&config); err != nil {
+		return config, err
+	}
+
+	// Only the flags given on the command line, the zero values must not
+	// override what came before
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "token":
+			config.Token = *token
+		case "admins":
+			if ids, e := parseIDs(*admins); e != nil {
+				err = fmt.Errorf("Invalid -admins: %s", e)
+			} else {
+				config.Admins = ids
+			}
+		case "workers":
+			config.Workers = *workers
+		case "db":
+			config.Database.Path = *dbPath
+		case "pool-size":
+			config.Database.PoolSize = *poolSize
+		case "mode":
+			config.Telegram.Mode = *mode
+		case "webhook-url":
+			config.Telegram.WebhookURL = *webhookURL
+		case "webhook-listen":
+			config.Telegram.WebhookListen = *webhookListen
+		case "access":
+			config.Access.Mode = *access
+		case "metrics-listen":
+			config.Metrics.Listen = *metricsListen
+		case "log-level":
+			config.Log.Level = *logLevel
+		case "log-format":
+			config.Log.Format = *logFormat
+		case "backup-dir":
+			config.Backup.Dir = *backupDir
+		case "timezone":
+			config.Charts.Timezone = *timezone
+		}
+	})
+
+	if err != nil {
+		return config, err
+	}
+
+	if err := config.validate(); err != nil {
+		return config, err
+	}
+
+	config.Charts.timezone, err = loadTimezone(config.Charts.Timezone)
+	return config, err
+}
+
+// Picks the format by the extension, everything that is not YAML is JSON
+func readConfigFile(path string, config *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, config)
+	default:
+		// As strict as the YAML, a typo in a key should not go unnoticed
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to parse %s: %s", path, err)
+	}
+
+	return nil
+}
+
+func applyEnv(config *Config) error {
+	texts := map[string]*string{
+		"TOKEN":          &config.Token,
+		"DB_PATH":        &config.Database.Path,
+		"ENCRYPTION_KEY": &config.Database.EncryptionKey,
+		"MODE":           &config.Telegram.Mode,
+		"WEBHOOK_URL":    &config.Telegram.WebhookURL,
+		"WEBHOOK_LISTEN": &config.Telegram.WebhookListen,
+		"WEBHOOK_CERT":   &config.Telegram.WebhookCert,
+		"WEBHOOK_KEY":    &config.Telegram.WebhookKey,
+		"ACCESS":         &config.Access.Mode,
+		"METRICS_LISTEN": &config.Metrics.Listen,
+		"LOG_LEVEL":      &config.Log.Level,
+		"LOG_FORMAT":     &config.Log.Format,
+		"BACKUP_DIR":     &config.Backup.Dir,
+		"TIMEZONE":       &config.Charts.Timezone,
+	}
+
+	for name, value := range texts {
+		if s, ok := os.LookupEnv(envPrefix + name); ok {
+			*value = s
+		}
+	}
+
+	ints := map[string]*int{
+		"WORKERS":      &config.Workers,
+		"DB_POOL_SIZE": &config.Database.PoolSize,
+		"POLL_TIMEOUT": &config.Telegram.PollTimeout,
+		"RATE_LIMIT":   &config.RateLimit.PerMinute,
+	}
+
+	for name, value := range ints {
+		if s, ok := os.LookupEnv(envPrefix + name); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("Invalid %s%s: '%s' is not a number", envPrefix, name, s)
+			}
+			*value = n
+		}
+	}
+
+	if s, ok := os.LookupEnv(envPrefix + "LOG_USER_TEXTS"); ok {
+		show, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("Invalid %sLOG_USER_TEXTS: '%s' is not true or false", envPrefix, s)
+		}
+		config.Log.ShowUserTexts = show
+	}
+
+	if s, ok := os.LookupEnv(envPrefix + "ADMINS"); ok {
+		ids, err := parseIDs(s)
+		if err != nil {
+			return fmt.Errorf("Invalid %sADMINS: %s", envPrefix, err)
+		}
+		config.Admins = ids
+	}
+
+	return nil
+}
+
+// Checks everything at once, so all the problems are reported in one go
+func (c Config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Database.Path != "", "database path is empty")
+	check(c.Database.PoolSize > 0, "database pool size must be positive, got %d", c.Database.PoolSize)
+	check(c.Workers > 0, "number of workers must be positive, got %d", c.Workers)
+	check(c.Workers+reservedConnections <= c.Database.PoolSize,
+		"number of workers (%d) plus %d connections for the background jobs can't be more than the database pool size (%d)",
+		c.Workers,
+		reservedConnections,
+		c.Database.PoolSize)
+
+	if c.Database.EncryptionKey != "" {
+		_, err := parseEncryptionKey(c.Database.EncryptionKey)
+		check(err == nil, "encryption key %v", err)
+	}
+
+	switch c.Telegram.Mode {
+	case pollingMode:
+		check(c.Telegram.PollTimeout >= 0, "poll timeout can't be negative, got %d", c.Telegram.PollTimeout)
+	case webhookMode:
+		check(strings.HasPrefix(c.Telegram.WebhookURL, "https://"),
+			"webhook URL must start with https://, got '%s'",
+			c.Telegram.WebhookURL)
+		check(c.Telegram.WebhookListen != "", "webhook listen address is empty")
+		check((c.Telegram.WebhookCert == "") == (c.Telegram.WebhookKey == ""),
+			"webhook certificate and key must be set together")
+	default:
+		check(false, "mode must be '%s' or '%s', got '%s'", pollingMode, webhookMode, c.Telegram.Mode)
+	}
+
+	for _, id := range c.Admins {
+		check(id > 0, "admin ID must be positive, got %d", id)
+	}
+
+	switch c.Access.Mode {
+	case openAccess, allowlistAccess, inviteAccess:
+	default:
+		check(false,
+			"access must be '%s', '%s' or '%s', got '%s'",
+			openAccess,
+			allowlistAccess,
+			inviteAccess,
+			c.Access.Mode)
+	}
+
+	for _, id := range c.Access.Allowlist {
+		check(id > 0, "allowlist user ID must be positive, got %d", id)
+	}
+
+	_, knownLevel := logLevels[strings.ToLower(c.Log.Level)]
+	check(knownLevel, "log level must be debug, info, warn or error, got '%s'", c.Log.Level)
+	check(c.Log.Format == logfmtLogFormat || c.Log.Format == jsonLogFormat,
+		"log format must be '%s' or '%s', got '%s'",
+		logfmtLogFormat,
+		jsonLogFormat,
+		c.Log.Format)
+
+	check(c.RateLimit.PerMinute >= 0, "rate limit can't be negative, got %d", c.RateLimit.PerMinute)
+	check(c.RateLimit.PerMinute == 0 || c.RateLimit.Burst > 0,
+		"rate limit burst must be positive, got %d",
+		c.RateLimit.Burst)
+
+	charts := c.Charts
+	check(charts.MaxDays >= 2, "chart max days must be at least 2, got %d", charts.MaxDays)
+	check(charts.MonthDays >= 1 && charts.MonthDays <= charts.MaxDays,
+		"chart month days must be from 1 to %d, got %d",
+		charts.MaxDays,
+		charts.MonthDays)
+	check(charts.YearWeeks >= 1 && charts.YearWeeks*daysPerWeek <= charts.MaxDays,
+		"chart year weeks must be from 1 to %d, got %d",
+		charts.MaxDays/daysPerWeek,
+		charts.YearWeeks)
+	check(charts.MaxTopCount >= minTopCount,
+		"chart max top count must be at least %d, got %d",
+		minTopCount,
+		charts.MaxTopCount)
+	check(charts.TopCount >= minTopCount && charts.TopCount <= charts.MaxTopCount,
+		"chart top count must be from %d to %d, got %d",
+		minTopCount,
+		charts.MaxTopCount,
+		charts.TopCount)
+	check(charts.MaxCompareCount >= minCompareCount,
+		"chart max compare count must be at least %d, got %d",
+		minCompareCount,
+		charts.MaxCompareCount)
+
+	_, err := loadTimezone(charts.Timezone)
+	check(err == nil, "chart time zone %v", err)
+
+	if len(problems) > 0 {
+		return errors.New("Invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// LoadLocation takes "" for UTC, here it's the server's time zone
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+
+	return time.LoadLocation(name)
+}
+
+// The time zone the charts count the days and the hours in
+func (c ChartsConfig) location() *time.Location {
+	if c.timezone == nil {
+		return time.Local
+	}
+
+	return c.timezone
+}
+
+// Parses "1, 2,3" into the IDs
+func parseIDs(s string) ([]int, error) {
+	ids := []int{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a user ID", field)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
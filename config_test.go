@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		fails  bool
+	}{
+		{"defaults", func(c *Config) {}, false},
+		{"no database", func(c *Config) { c.Database.Path = "" }, true},
+		{"no workers", func(c *Config) { c.Workers = 0 }, true},
+		{"workers fit the pool", func(c *Config) { c.Workers = c.Database.PoolSize - reservedConnections }, false},
+		{"no room for the jobs", func(c *Config) { c.Workers = c.Database.PoolSize - reservedConnections + 1 }, true},
+		{"webhook without https", func(c *Config) {
+			c.Telegram.Mode = webhookMode
+			c.Telegram.WebhookURL = "http://example.com/bot"
+			c.Telegram.WebhookListen = ":8443"
+		}, true},
+		{"webhook", func(c *Config) {
+			c.Telegram.Mode = webhookMode
+			c.Telegram.WebhookURL = "https://example.com/bot"
+			c.Telegram.WebhookListen = ":8443"
+		}, false},
+		{"unknown mode", func(c *Config) { c.Telegram.Mode = "carrier pigeon" }, true},
+		{"negative admin", func(c *Config) { c.Admins = []int{-1} }, true},
+		{"unknown access", func(c *Config) { c.Access.Mode = "everyone" }, true},
+		{"unknown log level", func(c *Config) { c.Log.Level = "loud" }, true},
+		{"rate limit without burst", func(c *Config) { c.RateLimit.PerMinute, c.RateLimit.Burst = 10, 0 }, true},
+		{"short month chart", func(c *Config) { c.Charts.MonthDays = 0 }, true},
+		{"unknown time zone", func(c *Config) { c.Charts.Timezone = "Mars/Olympus_Mons" }, true},
+	}
+
+	for _, test := range tests {
+		config := defaultConfig()
+		test.change(&config)
+
+		if err := config.validate(); (err != nil) != test.fails {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		file    string
+		content string
+		fails   bool
+	}{
+		{"config.json", `{"workers": 4, "database": {"pool_size": 12}}`, false},
+		{"config.json", `{"workers": 4, "databse": {"pool_size": 12}}`, true},
+		{"config.json", `{"database": {"poolsize": 12}}`, true},
+		{"config.yaml", "workers: 4\ndatabase:\n  pool_size: 12\n", false},
+		{"config.yaml", "workers: 4\ndatabase:\n  poolsize: 12\n", true},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), test.file)
+		if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		config := defaultConfig()
+		err := readConfigFile(path, &config)
+		if (err != nil) != test.fails {
+			t.Errorf("%s %q: got error %v", test.file, test.content, err)
+			continue
+		}
+
+		if err == nil && (config.Workers != 4 || config.Database.PoolSize != 12) {
+			t.Errorf("%s %q: got %d workers and %d connections", test.file, test.content, config.Workers, config.Database.PoolSize)
+		}
+	}
+}
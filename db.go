@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Sets up every connection of the pool once, right after it's opened. The pool
+// opens all of them at the start and keeps them, so taking them all out gets
+// every one of them.
+func initConnections(db *sqlitex.Pool, poolSize int) error {
+	connections := make([]*sqlite.Conn, 0, poolSize)
+	defer func() {
+		for _, connection := range connections {
+			db.Put(connection)
+		}
+	}()
+
+	for i := 0; i < poolSize; i++ {
+		connection := db.Get(nil)
+		if connection == nil {
+			return fmt.Errorf("Failed to get the database connection %d of %d", i+1, poolSize)
+		}
+
+		connections = append(connections, connection)
+
+		// Every query with the names fails without them
+		if err := registerNameFunctions(connection); err != nil {
+			return fmt.Errorf("Failed to register the name functions: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Takes a connection from the pool with the query timing turned on. The pool
+// resets the tracer on every Get, so all the connections must come from here.
+func getConnection(db *sqlitex.Pool) *sqlite.Conn {
+	started := time.Now()
+	connection := db.Get(nil)
+	poolWaitDuration.Observe(time.Since(started).Seconds())
+
+	if connection != nil {
+		connection.SetTracer(queryTracer{})
+	}
+
+	return connection
+}
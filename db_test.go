@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// What a test starts with. The names go in the way the bot stores them.
+type testData struct {
+	trackers []testTracker
+	events   []testEvent
+	blocked  []int
+}
+
+type testTracker struct {
+	id   int64
+	name string
+	// In the order they joined
+	members []testMember
+}
+
+type testMember struct {
+	user int
+	role string
+}
+
+// The user is 0 for the events in a tracker
+type testEvent struct {
+	user    int
+	author  int
+	tracker int64
+	name    string
+	date    int64
+}
+
+// A new database in a temporary directory with the data in it
+func openTestDB(t *testing.T, data testData) *sqlitex.Pool {
+	db, err := openDB(DatabaseConfig{Path: filepath.Join(t.TempDir(), "test.db"), PoolSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	exec := func(sql string, args ...interface{}) {
+		if err := sqlitex.Exec(connection, sql, nil, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tracker := range data.trackers {
+		exec("INSERT INTO trackers (id, name, name_hash, date) VALUES (?1, encrypt_name(?2), name_hash(?2), 0);", tracker.id, tracker.name)
+
+		for i, member := range tracker.members {
+			exec("INSERT INTO tracker_members (tracker, user, role, date) VALUES (?, ?, ?, ?);", tracker.id, member.user, member.role, i)
+		}
+	}
+
+	for _, e := range data.events {
+		exec(
+			"INSERT INTO events (user, author, tracker, name, name_hash, date) VALUES (NULLIF(?1, 0), ?2, NULLIF(?3, 0), encrypt_name(?4), name_hash(?4), ?5);",
+			e.user,
+			e.author,
+			e.tracker,
+			e.name,
+			e.date)
+	}
+
+	for _, user := range data.blocked {
+		exec("INSERT INTO blocked (user, date) VALUES (?, 0);", user)
+	}
+
+	return db
+}
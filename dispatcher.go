@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	defaultWorkerCount     = 8
+	defaultWorkerQueueSize = 64
+)
+
+// dispatcher processes the updates with a fixed number of workers. The updates
+// are sharded by the user ID, so the messages from the same user are handled
+// by the same worker one by one in the order they arrived, while the different
+// users are handled in parallel.
+type dispatcher struct {
+	queues []chan tgbotapi.Update
+	handle func(update tgbotapi.Update)
+	done   sync.WaitGroup
+
+	// To know how far the processing went
+	mutex   sync.Mutex
+	pending map[int]bool // IDs of the queued and running updates
+	lastID  int          // The last dispatched update ID
+
+	// Drops the updates from the users who send too much
+	limiter *rateLimiter
+	limited func(update tgbotapi.Update)
+}
+
+func newDispatcher(numWorkers int, queueSize int, handle func(update tgbotapi.Update)) *dispatcher {
+	d := &dispatcher{
+		queues:  make([]chan tgbotapi.Update, numWorkers),
+		handle:  handle,
+		pending: map[int]bool{},
+	}
+
+	for i := range d.queues {
+		d.queues[i] = make(chan tgbotapi.Update, queueSize)
+
+		d.done.Add(1)
+		go d.work(d.queues[i])
+	}
+
+	return d
+}
+
+// The updates over the limit are dropped. `limited` is called for the first
+// dropped one in a row, to let the user know.
+func (d *dispatcher) setRateLimit(limiter *rateLimiter, limited func(update tgbotapi.Update)) {
+	d.limiter = limiter
+	d.limited = limited
+}
+
+// Queues the update. Blocks when the worker for this user is too far behind,
+// which slows down the polling instead of piling up the goroutines.
+func (d *dispatcher) dispatch(update tgbotapi.Update) {
+	userID := updateUserID(update)
+
+	// The inline queries come with every key press, Telegram caches them anyway
+	allowed, warn := true, false
+	if d.limiter != nil && userID != 0 && update.InlineQuery == nil {
+		allowed, warn = d.limiter.allow(userID, time.Now())
+	}
+
+	d.mutex.Lock()
+	if allowed {
+		d.pending[update.UpdateID] = true
+	}
+	if update.UpdateID > d.lastID {
+		d.lastID = update.UpdateID
+	}
+	d.mutex.Unlock()
+
+	if !allowed {
+		slog.Info("Update is over the rate limit, dropped", "update_id", update.UpdateID, "user_id", userID)
+		if warn {
+			d.limited(update)
+		}
+		return
+	}
+
+	d.queues[d.shard(userID)] <- update
+}
+
+// Returns the ID of the first update that is not done yet. All the updates
+// before it are processed. Returns 0 when nothing has been dispatched.
+func (d *dispatcher) safeOffset() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.pending) == 0 {
+		if d.lastID == 0 {
+			return 0
+		}
+		return d.lastID + 1
+	}
+
+	offset := -1
+	for id := range d.pending {
+		if offset < 0 || id < offset {
+			offset = id
+		}
+	}
+
+	return offset
+}
+
+// Lets the workers finish what's already queued and waits for them
+func (d *dispatcher) stop() {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+
+	d.done.Wait()
+}
+
+func (d *dispatcher) work(queue chan tgbotapi.Update) {
+	defer d.done.Done()
+
+	for update := range queue {
+		d.handle(update)
+
+		d.mutex.Lock()
+		delete(d.pending, update.UpdateID)
+		d.mutex.Unlock()
+	}
+}
+
+func (d *dispatcher) shard(userID int) int {
+	return int(uint(userID) % uint(len(d.queues)))
+}
+
+// The user the update came from or 0 when there's none
+func updateUserID(update tgbotapi.Update) int {
+	if update.Message != nil && update.Message.From != nil {
+		return update.Message.From.ID
+	}
+
+	if update.CallbackQuery != nil && update.CallbackQuery.From != nil {
+		return update.CallbackQuery.From.ID
+	}
+
+	if update.InlineQuery != nil && update.InlineQuery.From != nil {
+		return update.InlineQuery.From.ID
+	}
+
+	if update.ChosenInlineResult != nil && update.ChosenInlineResult.From != nil {
+		return update.ChosenInlineResult.From.ID
+	}
+
+	return 0
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The event names could be sensitive, like the medication or the drinking.
+// With the key in the config they are stored encrypted with AES-GCM, and a
+// keyed HMAC of the name is stored next to them for the lookups and the
+// grouping. The queries go through the SQL functions:
+//
+//   name_hash(name)    - the HMAC to compare with the name_hash column
+//   encrypt_name(name) - what goes into the name column
+//   decrypt_name(name) - what comes out of it
+//
+// Without the key the names are stored as is and the HMAC is keyed with
+// nothing, so the queries are the same either way.
+
+const (
+	encryptionKeyLength = 32
+	encryptedNamePrefix = "enc1:"
+
+	// Which key the names in the database are stored with
+	nameKeyStateKey = "name_key"
+)
+
+type nameKeys struct {
+	// nil without the key
+	aead    cipher.AEAD
+	hashKey []byte
+}
+
+// Set once at the start from the config, like the logging
+var currentNameKeys = &nameKeys{}
+
+// The key is 32 random bytes in base64, like `openssl rand -base64 32`
+func parseEncryptionKey(key string) ([]byte, error) {
+	bytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("not valid base64")
+	}
+
+	if len(bytes) != encryptionKeyLength {
+		return nil, fmt.Errorf("must be %d bytes, got %d", encryptionKeyLength, len(bytes))
+	}
+
+	return bytes, nil
+}
+
+func setupEncryption(config DatabaseConfig) error {
+	if config.EncryptionKey == "" {
+		currentNameKeys = &nameKeys{}
+		return nil
+	}
+
+	key, err := parseEncryptionKey(config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+
+	// Separate keys for the encryption and the hashing
+	block, err := aes.NewCipher(deriveKey(key, "encryption"))
+	if err != nil {
+		return err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	currentNameKeys = &nameKeys{aead: aead, hashKey: deriveKey(key, "name hash")}
+	return nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// What is the same name for the lookups: "coffee" and "coffee ", and "café"
+// typed on the different keyboards, with the accent as a separate character
+// or not. The case stays, "Coffee" and "coffee" are different events like
+// they've always been. The hashes depend on it, changing it means a new
+// fingerprint.
+func normalizeName(name string) string {
+	return norm.NFC.String(strings.TrimSpace(name))
+}
+
+func (k *nameKeys) hash(name string) string {
+	mac := hmac.New(sha256.New, k.hashKey)
+	mac.Write([]byte(normalizeName(name)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Changes when the key changes, tells whether the names must be migrated
+func (k *nameKeys) fingerprint() int64 {
+	mac := hmac.New(sha256.New, k.hashKey)
+	mac.Write([]byte("since-bot name key"))
+	if k.aead != nil {
+		mac.Write([]byte("encrypted"))
+	}
+
+	return int64(binary.BigEndian.Uint64(mac.Sum(nil)))
+}
+
+func (k *nameKeys) encrypt(name string) (string, error) {
+	if k.aead == nil {
+		return name, nil
+	}
+
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := k.aead.Seal(nonce, nonce, []byte(name), nil)
+	return encryptedNamePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// The names stored before the encryption was turned on come out as is
+func (k *nameKeys) decrypt(value string) (string, error) {
+	if !isEncryptedName(value) {
+		return value, nil
+	}
+
+	if k.aead == nil {
+		return "", errors.New("The name is encrypted and there's no encryption key in the config")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedNamePrefix))
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return "", errors.New("The encrypted name is corrupted")
+	}
+
+	nonce, sealed := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	name, err := k.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", errors.New("Failed to decrypt the name, is the encryption key right?")
+	}
+
+	return string(name), nil
+}
+
+func isEncryptedName(value string) bool {
+	return strings.HasPrefix(value, encryptedNamePrefix)
+}
+
+// Once per connection when the database is opened, the pool keeps them open.
+// The keys are taken once here, so the same name always gets the same hash on
+// the connection and SQLite can treat the functions as deterministic.
+func registerNameFunctions(connection *sqlite.Conn) error {
+	keys := currentNameKeys
+
+	text := func(transform func(string) (string, error)) func(sqlite.Context, ...sqlite.Value) {
+		return func(ctx sqlite.Context, args ...sqlite.Value) {
+			if args[0].Type() == sqlite.SQLITE_NULL {
+				ctx.ResultNull()
+				return
+			}
+
+			result, err := transform(args[0].Text())
+			if err != nil {
+				ctx.ResultError(err)
+				return
+			}
+
+			ctx.ResultText(result)
+		}
+	}
+
+	functions := []struct {
+		name          string
+		deterministic bool
+		transform     func(string) (string, error)
+	}{
+		{"name_hash", true, func(name string) (string, error) { return keys.hash(name), nil }},
+		{"encrypt_name", false, func(name string) (string, error) { return keys.encrypt(name) }},
+		{"decrypt_name", true, func(value string) (string, error) { return keys.decrypt(value) }},
+	}
+
+	for _, f := range functions {
+		if err := connection.CreateFunction(f.name, f.deterministic, 1, text(f.transform), nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Encrypts the stored names in place when the encryption is turned on. The
+// first run on an older database fills in the hashes. The plain text copies
+// are vacuumed away.
+//
+// Turning it off or changing the key is not supported, the names can only be
+// decrypted with the current key.
+func migrateNames(db *sqlitex.Pool) error {
+	migrated, err := rewriteNames(db)
+	if err != nil || !migrated {
+		return err
+	}
+
+	return compactDB(db)
+}
+
+func rewriteNames(db *sqlitex.Pool) (migrated bool, err error) {
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	fingerprint := currentNameKeys.fingerprint()
+	stored, err := getState(connection, nameKeyStateKey)
+	if err != nil || stored == fingerprint {
+		return false, err
+	}
+
+	slog.Info("Migrating the event names", "encrypted", currentNameKeys.aead != nil)
+
+	defer sqlitex.Save(connection)(&err)
+
+	for _, table := range []string{"events", "trackers"} {
+		err = sqlitex.ExecTransient(
+			connection,
+			fmt.Sprintf(`UPDATE "%s" SET `+
+				"name = encrypt_name(decrypt_name(name)), "+
+				"name_hash = name_hash(decrypt_name(name));", table),
+			nil)
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if err = setState(connection, nameKeyStateKey, fingerprint); err != nil {
+		return false, err
+	}
+
+	return true, setState(connection, compactPendingKey, 1)
+}
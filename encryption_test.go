@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testEncryptionKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func mustNameKeys(t *testing.T, key string) *nameKeys {
+	if err := setupEncryption(DatabaseConfig{EncryptionKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	return currentNameKeys
+}
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name       string
+		normalized string
+	}{
+		{"coffee", "coffee"},
+		{"  coffee ", "coffee"},
+		{"Coffee", "Coffee"},
+		{"GREEN Tea", "GREEN Tea"},
+		// The accent as a separate character
+		{"cafe\u0301", "caf\u00e9"},
+		{"CAFE\u0301", "CAF\u00c9"},
+		{"Straße", "Straße"},
+	}
+
+	for _, test := range tests {
+		if normalized := normalizeName(test.name); normalized != test.normalized {
+			t.Errorf("%q: got %q, want %q", test.name, normalized, test.normalized)
+		}
+	}
+}
+
+func TestNameHash(t *testing.T) {
+	for _, key := range []string{"", testEncryptionKey} {
+		keys := mustNameKeys(t, key)
+
+		if keys.hash("cafe\u0301 ") != keys.hash("caf\u00e9") {
+			t.Errorf("key '%s': the same names get different hashes", key)
+		}
+
+		if keys.hash("coffee") == keys.hash("tea") || keys.hash("coffee") == keys.hash("Coffee") {
+			t.Errorf("key '%s': the different names get the same hash", key)
+		}
+	}
+
+	if mustNameKeys(t, "").hash("coffee") == mustNameKeys(t, testEncryptionKey).hash("coffee") {
+		t.Error("the hash doesn't depend on the key")
+	}
+
+	if mustNameKeys(t, "").fingerprint() == mustNameKeys(t, testEncryptionKey).fingerprint() {
+		t.Error("the fingerprint doesn't depend on the key")
+	}
+}
+
+func TestEncryptName(t *testing.T) {
+	keys := mustNameKeys(t, testEncryptionKey)
+
+	encrypted, err := keys.encrypt("coffee")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isEncryptedName(encrypted) || strings.Contains(encrypted, "coffee") {
+		t.Errorf("got %q", encrypted)
+	}
+
+	// A new nonce every time
+	again, _ := keys.encrypt("coffee")
+	if again == encrypted {
+		t.Error("the same name is encrypted the same way twice")
+	}
+
+	tests := []struct {
+		value string
+		name  string
+		fails bool
+	}{
+		{encrypted, "coffee", false},
+		{again, "coffee", false},
+		// Stored before the encryption was turned on
+		{"tea", "tea", false},
+		{encryptedNamePrefix + "not base64!", "", true},
+		{encryptedNamePrefix + "AAAA", "", true},
+		{encrypted[:len(encrypted)-4] + "AAA=", "", true},
+	}
+
+	for _, test := range tests {
+		name, err := keys.decrypt(test.value)
+		if (err != nil) != test.fails || name != test.name {
+			t.Errorf("%q: got %q and error %v", test.value, name, err)
+		}
+	}
+
+	// Without the key or with another one it's not readable
+	if _, err := mustNameKeys(t, "").decrypt(encrypted); err == nil {
+		t.Error("decrypted without the key")
+	}
+
+	other := mustNameKeys(t, "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=")
+	if _, err := other.decrypt(encrypted); err == nil {
+		t.Error("decrypted with another key")
+	}
+
+	// Without the key the names stay as they are
+	if plain, _ := mustNameKeys(t, "").encrypt("coffee"); plain != "coffee" {
+		t.Errorf("got %q without the key", plain)
+	}
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		fails bool
+	}{
+		{testEncryptionKey, false},
+		{"not base64!", true},
+		{"c2hvcnQ=", true},
+		{"", true},
+	}
+
+	for _, test := range tests {
+		if _, err := parseEncryptionKey(test.key); (err != nil) != test.fails {
+			t.Errorf("%q: got error %v", test.key, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Telegram doesn't accept longer messages
+const maxMessageLength = 4096
+
+// What the users see when something goes wrong, by the language code
+var internalErrorMessages = map[string]string{
+	"en": "Sorry, something went wrong. Please try again later.",
+	"de": "Entschuldigung, etwas ist schiefgelaufen. Bitte versuche es später noch einmal.",
+	"es": "Lo siento, algo salió mal. Por favor, inténtalo de nuevo más tarde.",
+	"fr": "Désolé, une erreur s'est produite. Veuillez réessayer plus tard.",
+	"ru": "Извините, что-то пошло не так. Пожалуйста, попробуйте позже.",
+}
+
+// Picks the message for "en-US", "en" and such, English is the fallback
+func internalErrorMessage(languageCode string) string {
+	language := strings.ToLower(languageCode)
+	if i := strings.IndexAny(language, "-_"); i >= 0 {
+		language = language[:i]
+	}
+
+	if message, ok := internalErrorMessages[language]; ok {
+		return message
+	}
+
+	return internalErrorMessages["en"]
+}
+
+// Logs the error and apologizes to the user. The details are not shown to the
+// user, they might contain something internal.
+func (c context) handleError(err error) {
+	c.logger().Error("Update failed", "error", err)
+	c.apologize()
+}
+
+// Same as handleError, but the panic details go to the admins as well
+func (c context) handlePanic(r interface{}, stack []byte) {
+	c.logger().Error("Update panicked", "panic", r, "stack", string(stack))
+	c.apologize()
+	c.notifyAdmins(fmt.Sprintf("Panic in update %d from '%s': %v\n\n%s", c.updateID, c.message.From, r, stack))
+}
+
+func (c context) apologize() {
+	languageCode := ""
+	if c.message.From != nil {
+		languageCode = c.message.From.LanguageCode
+	}
+
+	if err := c.sendText(internalErrorMessage(languageCode)); err != nil {
+		c.logger().Error("Failed to report the error", "error", err)
+	}
+}
+
+func (c context) notifyAdmins(text string) {
+	if debugChartEnabled || c.bot == nil {
+		return
+	}
+
+	if runes := []rune(text); len(runes) > maxMessageLength {
+		text = string(runes[:maxMessageLength])
+	}
+
+	for _, id := range c.config.Admins {
+		if err := c.send(int64(id), tgbotapi.NewMessage(int64(id), text)); err != nil {
+			c.logger().Error("Failed to notify the admin", "admin_id", id, "error", err)
+		}
+	}
+}
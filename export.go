@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+const (
+	jsonDumpVersion = 1
+
+	icsTimeLayout    = "20060102T150405Z"
+	icsMaxLineLength = 75
+)
+
+// Tables with the per user data that go into the full JSON dump and the rows
+// that belong to the user, ?1 is the user ID. Every new table with the user
+// data goes here, the ones without any go to internalTables. The test checks
+// that every table in the schema is in one of them.
+var exportedTables = []struct {
+	table string
+	where string
+}{
+	// The same events the CSV has and the ones the user logged in the groups
+	{"events", visibleEvents + " OR author = ?1"},
+	{"trackers", "id IN (SELECT tracker FROM tracker_members WHERE user = ?1)"},
+	{"tracker_members", "user = ?1"},
+	{"tracker_invites", "owner = ?1 OR user = ?1"},
+	{"shared_chats", "chat = ?1 OR user = ?1"},
+	{"allowed", "user = ?1"},
+	{"blocked", "user = ?1"},
+	{"invites", "admin = ?1 OR user = ?1"},
+	{"audit", "admin = ?1"},
+}
+
+// Tables that don't have anything about the users
+var internalTables = []string{"state", "updates"}
+
+// Writes the events as "name,RFC3339 date" rows, the oldest first. When the
+// name is not empty only the events with that name are written.
+func writeEventsCSV(w io.Writer, connection *sqlite.Conn, userID int, name string) error {
+	writer := csv.NewWriter(w)
+
+	query := "SELECT decrypt_name(name) name, date FROM events WHERE " + visibleEvents
+	args := []interface{}{userID}
+	if name != "" {
+		query += " AND name_hash = name_hash(?)"
+		args = append(args, name)
+	}
+	query += " ORDER BY date"
+
+	// This is most likely a rarely used command, so we use a non caching version
+	err := sqlitex.ExecTransient(
+		connection,
+		query,
+		func(s *sqlite.Stmt) error {
+			return writer.Write([]string{
+				s.GetText("name"),
+				time.Unix(s.GetInt64("date"), 0).Format(time.RFC3339),
+			})
+		},
+		args...)
+
+	if err != nil {
+		return err
+	}
+
+	// Never forget to flush when you're done
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// Writes every row of every exported table that belongs to the user. All the
+// columns are written as is, so nothing is lost. It's a dump to keep, the
+// import only takes the events from it. The rows are written one by one as
+// they come out of the database.
+func writeJSONDump(w io.Writer, connection *sqlite.Conn, userID int, now time.Time) error {
+	_, err := fmt.Fprintf(
+		w,
+		`{"version":%d,"user":%d,"exported":"%s","tables":{`,
+		jsonDumpVersion,
+		userID,
+		now.Format(time.RFC3339))
+
+	if err != nil {
+		return err
+	}
+
+	for i, t := range exportedTables {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+
+		if err := writeTableJSON(w, connection, t.table, t.where, userID); err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(w, "}}\n")
+	return err
+}
+
+// Writes `"table":[{...},{...}]` with one object per row
+func writeTableJSON(w io.Writer, connection *sqlite.Conn, table string, where string, userID int) error {
+	if _, err := fmt.Fprintf(w, "%q:[", table); err != nil {
+		return err
+	}
+
+	first := true
+	err := sqlitex.ExecTransient(
+		connection,
+		fmt.Sprintf(`SELECT * FROM "%s" WHERE %s`, table, where),
+		func(s *sqlite.Stmt) error {
+			if !first {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			first = false
+
+			return writeRowJSON(w, s)
+		},
+		userID)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]")
+	return err
+}
+
+// Writes the current row as a JSON object keeping the column order. The
+// encrypted names go out decrypted, the dump is for the user.
+func writeRowJSON(w io.Writer, s *sqlite.Stmt) error {
+	row := strings.Builder{}
+	row.WriteString("{")
+
+	for i := 0; i < s.ColumnCount(); i++ {
+		// Only means something with the key of this database
+		if s.ColumnName(i) == "name_hash" {
+			continue
+		}
+
+		if row.Len() > 1 {
+			row.WriteString(",")
+		}
+
+		key, err := json.Marshal(s.ColumnName(i))
+		if err != nil {
+			return err
+		}
+
+		column := columnValue(s, i)
+		if text, ok := column.(string); ok && isEncryptedName(text) {
+			if column, err = currentNameKeys.decrypt(text); err != nil {
+				return err
+			}
+		}
+
+		value, err := json.Marshal(column)
+		if err != nil {
+			return err
+		}
+
+		row.Write(key)
+		row.WriteString(":")
+		row.Write(value)
+	}
+
+	row.WriteString("}")
+
+	_, err := io.WriteString(w, row.String())
+	return err
+}
+
+func columnValue(s *sqlite.Stmt, col int) interface{} {
+	switch s.ColumnType(col) {
+	case sqlite.SQLITE_INTEGER:
+		return s.ColumnInt64(col)
+	case sqlite.SQLITE_FLOAT:
+		return s.ColumnFloat(col)
+	case sqlite.SQLITE_TEXT:
+		return s.ColumnText(col)
+	case sqlite.SQLITE_BLOB:
+		buffer := make([]byte, s.ColumnLen(col))
+		s.ColumnBytes(col, buffer)
+		return buffer
+	}
+
+	return nil
+}
+
+// Writes the events as an iCalendar file with one VEVENT per event. When the
+// name is not empty only the events with that name are written.
+func writeICalendar(w io.Writer, connection *sqlite.Conn, userID int, name string, now time.Time) error {
+	err := writeICSLines(
+		w,
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//since-bot//EN",
+		"CALSCALE:GREGORIAN")
+
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT id, decrypt_name(name) name, date FROM events WHERE " + visibleEvents
+	args := []interface{}{userID}
+	if name != "" {
+		query += " AND name_hash = name_hash(?)"
+		args = append(args, name)
+	}
+	query += " ORDER BY date"
+
+	stamp := now.UTC().Format(icsTimeLayout)
+	err = sqlitex.ExecTransient(
+		connection,
+		query,
+		func(s *sqlite.Stmt) error {
+			date := time.Unix(s.GetInt64("date"), 0).UTC()
+			return writeICSLines(
+				w,
+				"BEGIN:VEVENT",
+				fmt.Sprintf("UID:%d-%d@since-bot", userID, s.GetInt64("id")),
+				"DTSTAMP:"+stamp,
+				"DTSTART:"+date.Format(icsTimeLayout),
+				"SUMMARY:"+escapeICSText(s.GetText("name")),
+				"END:VEVENT")
+		},
+		args...)
+
+	if err != nil {
+		return err
+	}
+
+	return writeICSLines(w, "END:VCALENDAR")
+}
+
+// Writes CRLF terminated lines folded at 75 octets as RFC 5545 requires
+func writeICSLines(w io.Writer, lines ...string) error {
+	for _, line := range lines {
+		limit := icsMaxLineLength
+		for len(line) > limit {
+			// Don't split the multibyte characters
+			cut := limit
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+
+			if _, err := io.WriteString(w, line[:cut]+"\r\n "); err != nil {
+				return err
+			}
+
+			// The continuation starts with a space that counts towards the limit
+			line = line[cut:]
+			limit = icsMaxLineLength - 1
+		}
+
+		if _, err := io.WriteString(w, line+"\r\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var icsTextEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\n", `\n`,
+	"\r", "")
+
+func escapeICSText(text string) string {
+	return icsTextEscaper.Replace(text)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A new table has to be either exported or marked as internal
+func TestExportedTablesCoverSchema(t *testing.T) {
+	known := map[string]bool{}
+	for _, table := range exportedTables {
+		known[table.table] = true
+	}
+	for _, table := range internalTables {
+		known[table] = true
+	}
+
+	tableRegexp := regexp.MustCompile(`CREATE TABLE IF NOT EXISTS (\w+)`)
+	for _, sql := range schema {
+		if m := tableRegexp.FindStringSubmatch(sql); m != nil && !known[m[1]] {
+			t.Errorf("%s is neither in exportedTables nor in internalTables", m[1])
+		}
+	}
+}
+
+func TestJSONDumpEvents(t *testing.T) {
+	db := openTestDB(t, testData{
+		trackers: []testTracker{{7, "walk", []testMember{{1, memberRole}, {2, ownerRole}}}},
+		events: []testEvent{
+			{user: 1, author: 1, name: "coffee", date: 1},
+			{user: -100, author: 1, name: "pizza", date: 2},
+			{user: 2, author: 2, name: "tea", date: 3},
+			{tracker: 7, author: 2, name: "walk", date: 5},
+		},
+	})
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	var buffer bytes.Buffer
+	if err := writeJSONDump(&buffer, connection, 1, time.Unix(10, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	var dump struct {
+		Tables map[string][]map[string]interface{} `json:"tables"`
+	}
+	if err := json.Unmarshal(buffer.Bytes(), &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	// Own, logged in the group and in the shared tracker
+	var names []string
+	for _, event := range dump.Tables["events"] {
+		names = append(names, event["name"].(string))
+	}
+	if strings.Join(names, ",") != "coffee,pizza,walk" {
+		t.Errorf("got the events %v", names)
+	}
+
+	if len(dump.Tables["trackers"]) != 1 || len(dump.Tables["tracker_members"]) != 1 {
+		t.Errorf("got the trackers %v and the members %v", dump.Tables["trackers"], dump.Tables["tracker_members"])
+	}
+
+	// The CSV has the events the user sees, optionally only one of them
+	buffer.Reset()
+	if err := writeEventsCSV(&buffer, connection, 1, "walk"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buffer.String(), "walk,") || strings.Count(buffer.String(), "\n") != 1 {
+		t.Errorf("got the CSV %q", buffer.String())
+	}
+}
+
+func TestWriteICSLines(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"SUMMARY:coffee", "SUMMARY:coffee\r\n"},
+		{strings.Repeat("a", 75), strings.Repeat("a", 75) + "\r\n"},
+		{strings.Repeat("a", 76), strings.Repeat("a", 75) + "\r\n a\r\n"},
+		{strings.Repeat("a", 150), strings.Repeat("a", 75) + "\r\n " + strings.Repeat("a", 74) + "\r\n a\r\n"},
+		// The 2 byte characters stay whole
+		{strings.Repeat("a", 74) + "ää", strings.Repeat("a", 74) + "\r\n ää\r\n"},
+	}
+
+	for _, test := range tests {
+		var buffer bytes.Buffer
+		if err := writeICSLines(&buffer, test.line); err != nil {
+			t.Fatal(err)
+		}
+
+		if buffer.String() != test.want {
+			t.Errorf("%q: got %q, want %q", test.line, buffer.String(), test.want)
+		}
+	}
+}
+
+func TestEscapeICSText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"coffee", "coffee"},
+		{"green, tea; milk", `green\, tea\; milk`},
+		{`a\b`, `a\\b`},
+		{"two\r\nlines", `two\nlines`},
+	}
+
+	for _, test := range tests {
+		if got := escapeICSText(test.text); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	forgetCallbackPrefix   = "forget:"
+	deleteMeCallbackPrefix = "deleteme:"
+	cancelCallbackData     = "cancel"
+
+	// The buttons stop working after that, the user might've changed their mind
+	confirmationTimeout = 5 * time.Minute
+
+	// The deleted data stays in the free pages of the file until it's vacuumed.
+	// That's done in the background not to lock the database for every user.
+	compactPendingKey = "compact_pending"
+	compactInterval   = time.Hour
+
+	expiredConfirmationMessage = "This has expired, nothing's deleted. Please send the command again."
+)
+
+func (c context) forget(name string) error {
+	if name == "" {
+		return c.sendMarkdown("Please provide a name: /forget *name*")
+	}
+
+	if c.owner != c.message.From.ID {
+		isChatAdmin, err := c.isChatAdmin()
+		if err != nil {
+			return err
+		}
+
+		if !isChatAdmin {
+			return c.sendText("Only the group admins can delete the group events")
+		}
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	eventID, err := lastEventID(connection, c.owner, name)
+	if err != nil {
+		return err
+	}
+
+	if eventID == 0 {
+		return c.sendText(fmt.Sprintf("There's no '%s' to forget", name))
+	}
+
+	count, err := countRows(connection, "SELECT COUNT(*) FROM events WHERE "+visibleEvents+" AND name_hash = name_hash(?);", c.owner, name)
+	if err != nil {
+		return err
+	}
+
+	text := fmt.Sprintf("This deletes all the %d '%s' events for good. Sure?", count, name)
+
+	_, role, err := findTracker(connection, c.owner, name)
+	if err != nil {
+		return err
+	}
+
+	switch role {
+	case ownerRole:
+		text = fmt.Sprintf("'%s' is shared, this deletes all the %d events for everyone in it for good. Sure?", name, count)
+	case memberRole, viewerRole:
+		text = fmt.Sprintf("'%s' is shared, you leave it and the events you logged there are deleted for good. Sure?", name)
+	}
+
+	return c.confirm(text, fmt.Sprintf("%s%d", forgetCallbackPrefix, eventID))
+}
+
+func (c context) deleteMe() error {
+	return c.confirm(
+		deleteMeText(c.config.Backup.Dir != ""),
+		fmt.Sprintf("%s%d", deleteMeCallbackPrefix, c.message.From.ID))
+}
+
+// Exactly what deleteUserData does, it's the one command that must not
+// promise more than it deletes
+func deleteMeText(backups bool) string {
+	text := "This deletes all your events for good: the personal ones and the ones you logged in the groups and the shared trackers. " +
+		"The shared trackers you own pass to the member who joined first, and the entries of the other members stay. " +
+		"The trackers with nobody left to log in them are deleted. " +
+		"The admin records of your access stay: the audit log, the allowlist and the block list."
+
+	if backups {
+		text += fmt.Sprintf(" The backups still have your data for up to %d weeks.", weeklyBackupDays/daysPerWeek)
+	}
+
+	return text + " Sure?"
+}
+
+// Asks with a yes and a no button
+func (c context) confirm(text string, yesCallbackData string) error {
+	return c.sendInlineKeyboard(text, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("Yes, delete", yesCallbackData),
+		tgbotapi.NewInlineKeyboardButtonData("No", cancelCallbackData),
+	})
+}
+
+// The age of the message with the buttons is the age of the question. The
+// inline messages don't have it, they never get a confirmation anyway.
+func (c context) confirmationExpired() bool {
+	message := c.callback.Message
+	return message == nil || c.now().Sub(time.Unix(int64(message.Date), 0)) > confirmationTimeout
+}
+
+func (c context) cancelConfirmation() error {
+	if err := c.answerCallback(""); err != nil {
+		return err
+	}
+
+	return c.editText("Okay, nothing's deleted")
+}
+
+// "forget:123" from the confirmation
+func (c context) forgetByID(arg string) error {
+	eventID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return c.answerCallback("This button doesn't work anymore")
+	}
+
+	// Anyone in the group could press it
+	if c.owner != c.message.From.ID {
+		isChatAdmin, err := c.isChatAdmin()
+		if err != nil {
+			return err
+		}
+
+		if !isChatAdmin {
+			return c.answerCallback("Only the group admins can delete the group events")
+		}
+	}
+
+	if err := c.answerCallback(""); err != nil {
+		return err
+	}
+
+	if c.confirmationExpired() {
+		return c.editText(expiredConfirmationMessage)
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	name, err := eventNameByID(connection, c.owner, eventID)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		return c.editText("It's gone already")
+	}
+
+	deleted, err := forgetEvent(connection, c.owner, name)
+	if err != nil {
+		return err
+	}
+
+	c.logger().Info("Event forgotten", "name", redact(name), "deleted", deleted)
+
+	return c.editText(fmt.Sprintf("Done, '%s' is forgotten", name))
+}
+
+// "deleteme:123" from the confirmation
+func (c context) deleteMeByID(arg string) error {
+	userID, err := strconv.Atoi(arg)
+	if err != nil || userID != c.message.From.ID {
+		return c.answerCallback("This button is not for you")
+	}
+
+	if err := c.answerCallback(""); err != nil {
+		return err
+	}
+
+	if c.confirmationExpired() {
+		return c.editText(expiredConfirmationMessage)
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	deleted, err := deleteUserData(connection, userID)
+	if err != nil {
+		return err
+	}
+
+	c.logger().Info("User data deleted", "deleted", deleted)
+
+	return c.editText("Done, everything is deleted. Send an event name any time to start over.")
+}
+
+// Deletes the user's events with the name. A shared tracker is deleted for
+// everyone by the owner, the others only leave it with their own events.
+func forgetEvent(connection *sqlite.Conn, userID int, name string) (deleted int, err error) {
+	defer sqlitex.Save(connection)(&err)
+
+	// The personal events with the same name as a tracker go too
+	err = sqlitex.Exec(connection, "DELETE FROM events WHERE user = ? AND name_hash = name_hash(?);", nil, userID, name)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted = connection.Changes()
+
+	tracker, role, err := findTracker(connection, userID, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if tracker != 0 {
+		if role == ownerRole {
+			err = sqlitex.Exec(connection, "DELETE FROM tracker_members WHERE tracker = ?;", nil, tracker)
+		} else {
+			err = sqlitex.Exec(connection, "DELETE FROM events WHERE tracker = ? AND author = ?;", nil, tracker, userID)
+			deleted += connection.Changes()
+			if err == nil {
+				err = sqlitex.Exec(connection, "DELETE FROM tracker_members WHERE tracker = ? AND user = ?;", nil, tracker, userID)
+			}
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		count, err := deleteEmptyTrackers(connection)
+		if err != nil {
+			return 0, err
+		}
+
+		deleted += count
+	}
+
+	return deleted, setState(connection, compactPendingKey, 1)
+}
+
+// Deletes everything that belongs to the user or was logged by the user. The
+// owned trackers go to the member who joined first. The viewers can't log
+// anything, so the trackers with only the viewers left are deleted, like the
+// empty ones. The access tables stay, they belong to the admins.
+func deleteUserData(connection *sqlite.Conn, userID int) (deleted int, err error) {
+	defer sqlitex.Save(connection)(&err)
+
+	// Every new table with the user data goes here
+	statements := []string{
+		// The own ones and the ones logged in the groups and the trackers
+		"DELETE FROM events WHERE user = ?1 OR author = ?1;",
+		"DELETE FROM tracker_members WHERE user = ?1;",
+		"DELETE FROM tracker_invites WHERE owner = ?1 OR user = ?1;",
+		"UPDATE shared_chats SET user = NULL WHERE user = ?1;",
+	}
+
+	for _, sql := range statements {
+		if err = sqlitex.Exec(connection, sql, nil, userID); err != nil {
+			return 0, err
+		}
+
+		deleted += connection.Changes()
+	}
+
+	err = sqlitex.Exec(
+		connection,
+		"UPDATE tracker_members SET role = ?1 WHERE rowid IN ("+
+			"SELECT MIN(rowid) FROM tracker_members "+
+			"WHERE role = ?2 AND tracker NOT IN (SELECT tracker FROM tracker_members WHERE role = ?1) "+
+			"GROUP BY tracker);",
+		nil,
+		ownerRole,
+		memberRole)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = sqlitex.Exec(
+		connection,
+		"DELETE FROM tracker_members WHERE tracker NOT IN (SELECT tracker FROM tracker_members WHERE role = ?);",
+		nil,
+		ownerRole)
+
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := deleteEmptyTrackers(connection)
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted + count, setState(connection, compactPendingKey, 1)
+}
+
+// The trackers nobody is in anymore, with all their events
+func deleteEmptyTrackers(connection *sqlite.Conn) (int, error) {
+	statements := []string{
+		"DELETE FROM events WHERE tracker IS NOT NULL AND tracker NOT IN (SELECT tracker FROM tracker_members);",
+		"DELETE FROM tracker_invites WHERE tracker NOT IN (SELECT tracker FROM tracker_members);",
+		"DELETE FROM trackers WHERE id NOT IN (SELECT tracker FROM tracker_members);",
+	}
+
+	deleted := 0
+	for _, sql := range statements {
+		if err := sqlitex.Exec(connection, sql, nil); err != nil {
+			return 0, err
+		}
+
+		deleted += connection.Changes()
+	}
+
+	return deleted, nil
+}
+
+// Vacuums the database when something was deleted since the last time. The
+// WAL is truncated as well, it might have the deleted pages too.
+func compactDB(db *sqlitex.Pool) error {
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	pending, err := getState(connection, compactPendingKey)
+	if err != nil || pending == 0 {
+		return err
+	}
+
+	started := time.Now()
+
+	if err := sqlitex.ExecTransient(connection, "VACUUM;", nil); err != nil {
+		return err
+	}
+
+	if err := setState(connection, compactPendingKey, 0); err != nil {
+		return err
+	}
+
+	if err := sqlitex.ExecTransient(connection, "PRAGMA wal_checkpoint(TRUNCATE);", nil); err != nil {
+		return err
+	}
+
+	slog.Info("Database compacted", "duration", time.Since(started))
+
+	return nil
+}
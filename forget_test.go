@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeleteUserDataHandsOverTrackers(t *testing.T) {
+	// The user 1 owns the tracker 7 with a viewer and a member in it, and the
+	// tracker 8 with only a viewer
+	db := openTestDB(t, testData{
+		trackers: []testTracker{
+			{7, "walk", []testMember{{1, ownerRole}, {2, viewerRole}, {3, memberRole}}},
+			{8, "feeding", []testMember{{1, ownerRole}, {2, viewerRole}}},
+		},
+		events: []testEvent{
+			{tracker: 7, author: 3, name: "walk", date: 4},
+			{tracker: 8, author: 1, name: "feeding", date: 4},
+			{user: 1, author: 1, name: "coffee", date: 5},
+			{user: 2, author: 2, name: "tea", date: 5},
+		},
+	})
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	if _, err := deleteUserData(connection, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		count int
+	}{
+		// The member becomes the owner, not the viewer who joined earlier
+		{"SELECT COUNT(*) FROM tracker_members WHERE tracker = 7 AND user = 3 AND role = 'owner'", 1},
+		{"SELECT COUNT(*) FROM tracker_members WHERE tracker = 7 AND user = 2 AND role = 'viewer'", 1},
+		// Nobody can log into the tracker with only the viewer, it's gone
+		{"SELECT COUNT(*) FROM trackers WHERE id = 8", 0},
+		{"SELECT COUNT(*) FROM tracker_members WHERE tracker = 8", 0},
+		{"SELECT COUNT(*) FROM events WHERE tracker = 8", 0},
+		// The others keep their events
+		{"SELECT COUNT(*) FROM events WHERE tracker = 7", 1},
+		{"SELECT COUNT(*) FROM events WHERE user = 2", 1},
+		{"SELECT COUNT(*) FROM events WHERE user = 1 OR author = 1", 0},
+	}
+
+	for _, test := range tests {
+		count, err := countRows(connection, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != test.count {
+			t.Errorf("%s: got %d, want %d", test.query, count, test.count)
+		}
+	}
+}
+
+// The confirmation says what happens to everything deleteUserData touches
+func TestDeleteMeText(t *testing.T) {
+	for _, backups := range []bool{false, true} {
+		text := deleteMeText(backups)
+
+		for _, want := range []string{"shared trackers", "pass to the member who joined first", "other members stay", "audit log"} {
+			if !strings.Contains(text, want) {
+				t.Errorf("backups %v: no '%s' in %q", backups, want, text)
+			}
+		}
+
+		if strings.Contains(text, "backups") != backups {
+			t.Errorf("backups %v: got %q", backups, text)
+		}
+	}
+}
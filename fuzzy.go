@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	maxSuggestions = 4
+
+	// The short names are too easy to match by accident
+	shortNameLength = 4
+
+	sinceCallbackPrefix = "since:"
+)
+
+type similarName struct {
+	name     string
+	lastID   int64
+	count    int64
+	distance int
+}
+
+// Edit distance between the two strings, in runes
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			// Delete, insert or replace, whatever is the cheapest
+			current[j] = previous[j] + 1
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+			if previous[j-1]+cost < current[j] {
+				current[j] = previous[j-1] + cost
+			}
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(rb)]
+}
+
+// How far the name is from the one that was typed, ignoring the case. Returns
+// -1 when it's too far to be a typo. A prefix counts as a typo away.
+func nameDistance(typed, name string, maxDistance int, prefixes bool) int {
+	typed = strings.ToLower(typed)
+	name = strings.ToLower(name)
+
+	if typed == name {
+		return 0
+	}
+
+	if prefixes && strings.HasPrefix(name, typed) {
+		return 1
+	}
+
+	// One typo is all the short names get
+	if utf8.RuneCountInString(typed) <= shortNameLength && maxDistance > 1 {
+		maxDistance = 1
+	}
+
+	if d := levenshtein(typed, name); d <= maxDistance {
+		return d
+	}
+
+	return -1
+}
+
+// The user's event names that look like the typed one, the closest and the
+// most frequent first. The exact match is not included.
+func findSimilarNames(connection *sqlite.Conn, userID int, typed string, maxDistance int, prefixes bool) ([]similarName, error) {
+	names := []similarName{}
+	err := sqlitex.Exec(
+		connection,
+		"SELECT decrypt_name(name) name, MAX(id) last_id, COUNT(*) freq FROM events WHERE "+visibleEvents+" GROUP BY name_hash;",
+		func(s *sqlite.Stmt) error {
+			name := s.GetText("name")
+			if normalizeName(name) == normalizeName(typed) {
+				return nil
+			}
+
+			if d := nameDistance(typed, name, maxDistance, prefixes); d >= 0 {
+				names = append(names, similarName{
+					name:     name,
+					lastID:   s.GetInt64("last_id"),
+					count:    s.GetInt64("freq"),
+					distance: d,
+				})
+			}
+
+			return nil
+		},
+		userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].distance != names[j].distance {
+			return names[i].distance < names[j].distance
+		}
+		return names[i].count > names[j].count
+	})
+
+	if len(names) > maxSuggestions {
+		names = names[:maxSuggestions]
+	}
+
+	return names, nil
+}
+
+// Sends the text with a button for every suggested name
+func (c context) suggestNames(text string, names []similarName, callbackData func(eventID int64) string) error {
+	buttons := []tgbotapi.InlineKeyboardButton{}
+	for _, n := range names {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(n.name, callbackData(n.lastID)))
+	}
+
+	return c.sendInlineKeyboard(text, buttons)
+}
+
+func sinceCallbackData(eventID int64) string {
+	return fmt.Sprintf("%s%d", sinceCallbackPrefix, eventID)
+}
+
+// "Did you mean" from /since, replaces the question with the answer
+func (c context) sinceByID(arg string) error {
+	eventID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return c.answerCallback("This button doesn't work anymore")
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	name, err := eventNameByID(connection, c.owner, eventID)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		return c.answerCallback("This event is gone")
+	}
+
+	response, err := buildSinceResponse(name, int64(c.message.Date), int64(c.owner), connection)
+	if err != nil {
+		return err
+	}
+
+	if err := c.answerCallback(""); err != nil {
+		return err
+	}
+
+	return c.editText(response)
+}
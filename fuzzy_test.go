@@ -0,0 +1,90 @@
+package main
+
+import "testing"
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"coffee", "coffee", 0},
+		{"", "tea", 3},
+		{"tea", "", 3},
+		{"coffee", "cofee", 1},
+		{"coffee", "coffees", 1},
+		{"coffee", "toffee", 1},
+		{"coffee", "cofefe", 2},
+		{"kitten", "sitting", 3},
+		// Runes, not bytes
+		{"kaffee", "käffee", 1},
+		{"чай", "чаи", 1},
+	}
+
+	for _, test := range tests {
+		if d := levenshtein(test.a, test.b); d != test.distance {
+			t.Errorf("%s -> %s: got %d, want %d", test.a, test.b, d, test.distance)
+		}
+
+		if d := levenshtein(test.b, test.a); d != test.distance {
+			t.Errorf("%s -> %s: got %d, want %d", test.b, test.a, d, test.distance)
+		}
+	}
+}
+
+func TestNameDistance(t *testing.T) {
+	tests := []struct {
+		typed    string
+		name     string
+		max      int
+		prefixes bool
+		distance int
+	}{
+		{"coffee", "Coffee", 2, false, 0},
+		{"cofee", "coffee", 2, false, 1},
+		{"cofefe", "coffee", 2, false, 2},
+		{"cofefe", "coffee", 1, false, -1},
+		// The short ones only get one typo
+		{"tae", "tea", 2, false, -1},
+		{"tee", "tea", 2, false, 1},
+		// The prefixes only when asked for
+		{"cof", "coffee", 2, true, 1},
+		{"cof", "coffee", 2, false, -1},
+		{"walk", "run", 2, true, -1},
+	}
+
+	for _, test := range tests {
+		d := nameDistance(test.typed, test.name, test.max, test.prefixes)
+		if d != test.distance {
+			t.Errorf("%s -> %s (max %d, prefixes %v): got %d, want %d", test.typed, test.name, test.max, test.prefixes, d, test.distance)
+		}
+	}
+}
+
+func TestFindSimilarNames(t *testing.T) {
+	data := testData{}
+	for i, name := range []string{"coffee", "toffee", "toffee", "cofee", "tea", "coffee break"} {
+		data.events = append(data.events, testEvent{user: 1, author: 1, name: name, date: int64(i)})
+	}
+
+	db := openTestDB(t, data)
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	similar, err := findSimilarNames(connection, 1, "coffee", 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The exact match is left out, the more frequent goes first on a tie
+	want := []string{"toffee", "cofee"}
+	if len(similar) != len(want) {
+		t.Fatalf("got %v, want %v", similar, want)
+	}
+
+	for i, name := range want {
+		if similar[i].name != name {
+			t.Errorf("%d: got %s, want %s", i, similar[i].name, name)
+		}
+	}
+}
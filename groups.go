@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/hako/durafmt"
+)
+
+// In a group the commands could be for the other bots, like /help@otherbot.
+// The plain text is the members talking to each other, not the event names.
+func (c context) addressedToBot() bool {
+	message := c.message
+	if message.IsCommand() {
+		command := message.CommandWithAt()
+		if i := strings.Index(command, "@"); i >= 0 && c.bot != nil {
+			return strings.EqualFold(command[i+1:], c.bot.Self.UserName)
+		}
+		return true
+	}
+
+	return message.Chat == nil || message.Chat.IsPrivate()
+}
+
+// The chat in a shared group, the user everywhere else
+func (c context) eventOwner() (int, error) {
+	if c.message.Chat == nil || c.message.Chat.IsPrivate() {
+		return c.message.From.ID, nil
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	shared, err := isSharedChat(connection, c.message.Chat.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	if shared {
+		return int(c.message.Chat.ID), nil
+	}
+
+	return c.message.From.ID, nil
+}
+
+func isSharedChat(connection *sqlite.Conn, chatID int64) (bool, error) {
+	shared := false
+	err := sqlitex.Exec(
+		connection,
+		"SELECT 1 FROM shared_chats WHERE chat = ?;",
+		func(s *sqlite.Stmt) error {
+			shared = true
+			return nil
+		},
+		chatID)
+
+	return shared, err
+}
+
+// Turns the shared mode on and off for the group. Without the arguments just
+// reports the current mode.
+func (c context) group(args string) error {
+	chat := c.message.Chat
+	if chat.IsPrivate() {
+		return c.sendText("This only works in groups. Add me to one and send /group on there.")
+	}
+
+	arg := strings.ToLower(strings.TrimSpace(args))
+	switch arg {
+	case "on", "off":
+		isChatAdmin, err := c.isChatAdmin()
+		if err != nil {
+			return err
+		}
+
+		if !isChatAdmin {
+			return c.sendText("Only the group admins can change that")
+		}
+	case "":
+	default:
+		return c.sendMarkdown("Please use: /group *[on|off]*")
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	var err error
+	switch arg {
+	case "on":
+		err = sqlitex.Exec(
+			connection,
+			"INSERT OR IGNORE INTO shared_chats (chat, user, date) VALUES (?, ?, ?);",
+			nil,
+			chat.ID,
+			c.message.From.ID,
+			c.now().Unix())
+	case "off":
+		err = sqlitex.Exec(connection, "DELETE FROM shared_chats WHERE chat = ?;", nil, chat.ID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	shared, err := isSharedChat(connection, chat.ID)
+	if err != nil {
+		return err
+	}
+
+	if shared {
+		return c.sendText("The events logged here belong to the group, everyone sees and adds to the same ones")
+	}
+
+	return c.sendText("The events logged here belong to whoever logged them, everyone has their own")
+}
+
+// The bot admins can do it anywhere
+func (c context) isChatAdmin() (bool, error) {
+	if c.isAdmin() {
+		return true, nil
+	}
+
+	if debugChartEnabled {
+		return true, nil
+	}
+
+	member, err := c.bot.GetChatMember(tgbotapi.ChatConfigWithUser{
+		ChatID: c.message.Chat.ID,
+		UserID: c.message.From.ID,
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return member.IsCreator() || member.IsAdministrator(), nil
+}
+
+func (c context) who(name string) error {
+	if name == "" {
+		return c.sendMarkdown("Please provide a name: /who *name*")
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	// Before the groups there was no author, it's the owner then
+	authorID := 0
+	var date int64
+	err := sqlitex.Exec(
+		connection,
+		"SELECT COALESCE(author, user) author, date FROM events "+
+			"WHERE "+visibleEvents+" AND name_hash = name_hash(?) "+
+			"ORDER BY date DESC LIMIT 1;",
+		func(s *sqlite.Stmt) error {
+			authorID = int(s.GetInt64("author"))
+			date = s.GetInt64("date")
+			return nil
+		},
+		c.owner,
+		name)
+
+	if err != nil {
+		return err
+	}
+
+	if date == 0 {
+		return c.sendText(fmt.Sprintf("Nobody logged '%s' yet", name))
+	}
+
+	ago := durafmt.ParseShort(c.now().Sub(time.Unix(date, 0)))
+	return c.sendText(fmt.Sprintf("%s logged '%s' last, %s ago", c.memberName(authorID), name, ago))
+}
+
+// The name to show for the user, asks Telegram about the others
+func (c context) memberName(userID int) string {
+	if userID == c.message.From.ID {
+		return userName(c.message.From)
+	}
+
+	// Imported into the group, there's no one to point at
+	if userID < 0 {
+		return "Someone"
+	}
+
+	if debugChartEnabled || c.bot == nil {
+		return fmt.Sprintf("User %d", userID)
+	}
+
+	if c.message.Chat != nil && !c.message.Chat.IsPrivate() {
+		member, err := c.bot.GetChatMember(tgbotapi.ChatConfigWithUser{
+			ChatID: c.message.Chat.ID,
+			UserID: userID,
+		})
+
+		if err == nil && member.User != nil {
+			return userName(member.User)
+		}
+
+		c.logger().Warn("Failed to get the chat member", "member_id", userID, "error", err)
+	} else {
+		// The tracker members, they talked to the bot, so it knows them
+		chat, err := c.bot.GetChat(tgbotapi.ChatConfig{ChatID: int64(userID)})
+		if err == nil {
+			return userName(&tgbotapi.User{ID: userID, FirstName: chat.FirstName, LastName: chat.LastName, UserName: chat.UserName})
+		}
+
+		c.logger().Warn("Failed to get the user", "member_id", userID, "error", err)
+	}
+
+	return fmt.Sprintf("User %d", userID)
+}
+
+// Same, but asks only once for every user
+func (c context) memberNames() func(userID int) string {
+	names := map[int]string{}
+	return func(userID int) string {
+		name, ok := names[userID]
+		if !ok {
+			name = c.memberName(userID)
+			names[userID] = name
+		}
+
+		return name
+	}
+}
+
+func userName(user *tgbotapi.User) string {
+	if name := strings.TrimSpace(user.FirstName + " " + user.LastName); name != "" {
+		return name
+	}
+
+	if user.UserName != "" {
+		return "@" + user.UserName
+	}
+
+	return fmt.Sprintf("User %d", user.ID)
+}
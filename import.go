@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+const (
+	maxImportFileSize   = 10 * 1024 * 1024
+	maxReportedInvalids = 10
+)
+
+var errFileTooBig = errors.New("The file is too big")
+
+// A single event parsed from an imported file
+type importedEvent struct {
+	name string
+	date int64
+}
+
+// importResult summarizes what happened to the rows of an imported file
+type importResult struct {
+	imported int
+	skipped  int
+	invalid  []int // Numbers of the rows that failed to parse
+}
+
+// importer parses the events out of a file in some format. The rows that
+// cannot be parsed are reported by their number and don't fail the import.
+type importer interface {
+	parse(r io.Reader) ([]importedEvent, []int, error)
+}
+
+// Creates an importer configured with "key=value" options
+type importerFactory func(options map[string]string) (importer, error)
+
+// To support a new format add it here
+var importers = map[string]importerFactory{
+	"since": newExportCSVImporter,
+	"json":  newJSONDumpImporter,
+	"csv":   newGenericCSVImporter,
+	"loop":  newLoopImporter,
+}
+
+// Creates an importer for the format. The options are space separated
+// "key=value" pairs, pairs with spaces are quoted like "format=Jan 2 15:04".
+func newImporter(format string, options string) (importer, error) {
+	factory, ok := importers[strings.ToLower(format)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown import format '%s', supported formats are: %s", format, importFormats())
+	}
+
+	parsed, err := parseImportOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return factory(parsed)
+}
+
+func importFormats() string {
+	names := make([]string, 0, len(importers))
+	for name := range importers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+func parseImportOptions(options string) (map[string]string, error) {
+	parsed := map[string]string{}
+
+	options = strings.TrimSpace(options)
+	if options == "" {
+		return parsed, nil
+	}
+
+	// Quoting works the same way as in CSV
+	reader := csv.NewReader(strings.NewReader(options))
+	reader.Comma = ' '
+
+	fields, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the import options: %s", err)
+	}
+
+	for _, field := range fields {
+		if field == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Import options should look like key=value, got '%s'", field)
+		}
+
+		parsed[strings.ToLower(kv[0])] = kv[1]
+	}
+
+	return parsed, nil
+}
+
+//
+// The CSV produced by /export
+//
+
+type exportCSVImporter struct{}
+
+func newExportCSVImporter(options map[string]string) (importer, error) {
+	return exportCSVImporter{}, nil
+}
+
+// One "name,RFC3339 date" pair per row
+func (exportCSVImporter) parse(r io.Reader) ([]importedEvent, []int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	events := []importedEvent{}
+	invalid := []int{}
+
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			// Broken quoting and such, skip the row
+			if _, ok := err.(*csv.ParseError); ok {
+				invalid = append(invalid, row)
+				continue
+			}
+			return nil, nil, err
+		}
+
+		// Allow a header row, in case the file was edited in a spreadsheet
+		if row == 1 && isExportCSVHeader(record) {
+			continue
+		}
+
+		if len(record) != 2 {
+			invalid = append(invalid, row)
+			continue
+		}
+
+		name := strings.TrimSpace(record[0])
+		date, err := time.Parse(time.RFC3339, strings.TrimSpace(record[1]))
+		if name == "" || err != nil {
+			invalid = append(invalid, row)
+			continue
+		}
+
+		events = append(events, importedEvent{name: name, date: date.Unix()})
+	}
+
+	return events, invalid, nil
+}
+
+func isExportCSVHeader(record []string) bool {
+	return len(record) == 2 &&
+		strings.EqualFold(strings.TrimSpace(record[0]), "name") &&
+		strings.EqualFold(strings.TrimSpace(record[1]), "date")
+}
+
+//
+// The JSON dump produced by /export json. Only the events come back, the rest
+// of the dump is for the user to keep.
+//
+
+type jsonDumpImporter struct{}
+
+func newJSONDumpImporter(options map[string]string) (importer, error) {
+	return jsonDumpImporter{}, nil
+}
+
+func (jsonDumpImporter) parse(r io.Reader) ([]importedEvent, []int, error) {
+	var dump struct {
+		Version int `json:"version"`
+		Tables  struct {
+			Events []struct {
+				Name *string `json:"name"`
+				Date *int64  `json:"date"`
+			} `json:"events"`
+		} `json:"tables"`
+	}
+
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse the JSON dump: %s", err)
+	}
+
+	if dump.Version > jsonDumpVersion {
+		return nil, nil, fmt.Errorf("The JSON dump version %d is not supported", dump.Version)
+	}
+
+	events := []importedEvent{}
+	invalid := []int{}
+
+	for i, e := range dump.Tables.Events {
+		if e.Name == nil || e.Date == nil || strings.TrimSpace(*e.Name) == "" {
+			invalid = append(invalid, i+1)
+			continue
+		}
+
+		events = append(events, importedEvent{name: strings.TrimSpace(*e.Name), date: *e.Date})
+	}
+
+	return events, invalid, nil
+}
+
+//
+// A generic CSV with one event per row
+//
+
+// The columns are referenced either by the 1 based number or by the name in the
+// header row. The options are:
+//   - date - the date column, 1 by default
+//   - name - the name column, 2 by default
+//   - format - rfc3339 (default), unix, unixms or a Go time layout
+//   - sep - the field separator, a comma by default
+//   - header - yes when the first row is a header, implied when the columns
+//     are referenced by name
+type genericCSVImporter struct {
+	dateColumn string
+	nameColumn string
+	dateFormat string
+	comma      rune
+	header     bool
+}
+
+func newGenericCSVImporter(options map[string]string) (importer, error) {
+	i := genericCSVImporter{
+		dateColumn: "1",
+		nameColumn: "2",
+		dateFormat: "rfc3339",
+		comma:      ',',
+	}
+
+	for key, value := range options {
+		switch key {
+		case "date":
+			i.dateColumn = value
+		case "name":
+			i.nameColumn = value
+		case "format":
+			i.dateFormat = value
+		case "sep":
+			if value == `\t` {
+				value = "\t"
+			}
+
+			if utf8.RuneCountInString(value) != 1 {
+				return nil, fmt.Errorf("The separator must be a single character, got '%s'", value)
+			}
+
+			i.comma, _ = utf8.DecodeRuneInString(value)
+		case "header":
+			switch strings.ToLower(value) {
+			case "yes", "true", "1":
+				i.header = true
+			case "no", "false", "0":
+				i.header = false
+			default:
+				return nil, fmt.Errorf("The header option must be yes or no, got '%s'", value)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown CSV import option '%s'", key)
+		}
+	}
+
+	if !isColumnNumber(i.dateColumn) || !isColumnNumber(i.nameColumn) {
+		i.header = true
+	}
+
+	return i, nil
+}
+
+func (i genericCSVImporter) parse(r io.Reader) ([]importedEvent, []int, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = i.comma
+	reader.FieldsPerRecord = -1
+
+	events := []importedEvent{}
+	invalid := []int{}
+
+	dateIndex, _ := columnIndex(i.dateColumn, nil)
+	nameIndex, _ := columnIndex(i.nameColumn, nil)
+
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				invalid = append(invalid, row)
+				continue
+			}
+			return nil, nil, err
+		}
+
+		if row == 1 && i.header {
+			if dateIndex, err = columnIndex(i.dateColumn, record); err != nil {
+				return nil, nil, err
+			}
+			if nameIndex, err = columnIndex(i.nameColumn, record); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		if dateIndex >= len(record) || nameIndex >= len(record) {
+			invalid = append(invalid, row)
+			continue
+		}
+
+		name := strings.TrimSpace(record[nameIndex])
+		date, err := parseImportDate(strings.TrimSpace(record[dateIndex]), i.dateFormat)
+		if name == "" || err != nil {
+			invalid = append(invalid, row)
+			continue
+		}
+
+		events = append(events, importedEvent{name: name, date: date})
+	}
+
+	return events, invalid, nil
+}
+
+func isColumnNumber(column string) bool {
+	n, err := strconv.Atoi(column)
+	return err == nil && n > 0
+}
+
+// Finds the 0 based column index by the number or the name in the header
+func columnIndex(column string, header []string) (int, error) {
+	if isColumnNumber(column) {
+		n, _ := strconv.Atoi(column)
+		return n - 1, nil
+	}
+
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), column) {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("There's no column named '%s' in the header", column)
+}
+
+func parseImportDate(value string, format string) (int64, error) {
+	switch strings.ToLower(format) {
+	case "rfc3339":
+		date, err := time.Parse(time.RFC3339, value)
+		return date.Unix(), err
+	case "unix":
+		return strconv.ParseInt(value, 10, 64)
+	case "unixms":
+		ms, err := strconv.ParseInt(value, 10, 64)
+		return ms / 1000, err
+	}
+
+	// Dates without the time zone are in the local time
+	date, err := time.ParseInLocation(format, value, time.Local)
+	return date.Unix(), err
+}
+
+//
+// Loop Habit Tracker checkmarks CSV
+//
+
+// The first column is the date, then there's one column per habit with the
+// habit names in the header. Only the manually checked days (value 2) become
+// events. Loop doesn't store the time of the day, so the events are logged at
+// noon, which keeps them on the right day in most time zones.
+type loopImporter struct{}
+
+const (
+	loopDateLayout = "2006-01-02"
+	loopEventHour  = 12
+)
+
+// The checkmark values Loop writes. Only the manual check is something the
+// user did, the auto check is Loop filling the days between the checks of a
+// "3 times a week" habit. Anything else, like the amounts of the numerical
+// habits, makes the row invalid.
+const (
+	loopChecked     = "2"
+	loopAutoChecked = "1"
+	loopUnchecked   = "0"
+	loopUnknown     = "-1"
+	loopSkipped     = "3"
+)
+
+func newLoopImporter(options map[string]string) (importer, error) {
+	return loopImporter{}, nil
+}
+
+func (loopImporter) parse(r io.Reader) ([]importedEvent, []int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read the Loop Habit Tracker header: %s", err)
+	}
+
+	if len(header) < 2 {
+		return nil, nil, fmt.Errorf("The file doesn't look like Loop Habit Tracker checkmarks")
+	}
+
+	events := []importedEvent{}
+	invalid := []int{}
+
+	// The header is the row 1
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				invalid = append(invalid, row)
+				continue
+			}
+			return nil, nil, err
+		}
+
+		day, err := time.ParseInLocation(loopDateLayout, strings.TrimSpace(record[0]), time.Local)
+		if err != nil || len(record) > len(header) {
+			invalid = append(invalid, row)
+			continue
+		}
+
+		date := day.Add(loopEventHour * time.Hour).Unix()
+		rowEvents := []importedEvent{}
+		valid := true
+		for i := 1; i < len(record); i++ {
+			name := strings.TrimSpace(header[i])
+			switch strings.TrimSpace(record[i]) {
+			case loopChecked:
+				if name != "" {
+					rowEvents = append(rowEvents, importedEvent{name: name, date: date})
+				}
+			case loopAutoChecked, loopUnchecked, loopUnknown, loopSkipped, "":
+			default:
+				valid = false
+			}
+		}
+
+		if !valid {
+			invalid = append(invalid, row)
+			continue
+		}
+
+		events = append(events, rowEvents...)
+	}
+
+	return events, invalid, nil
+}
+
+//
+// Storage
+//
+
+// Inserts the events in one transaction skipping the ones that are already in
+// the database (the same user, name and date). Either all the new events are
+// stored or none. They go where the logged ones go, the names of the shared
+// trackers into the trackers.
+func storeImportedEvents(connection *sqlite.Conn, owner int, author int, events []importedEvent) (imported int, skipped int, err error) {
+	defer sqlitex.Save(connection)(&err)
+
+	for _, e := range events {
+		exists := false
+		err = sqlitex.Exec(
+			connection,
+			"SELECT 1 FROM events WHERE "+visibleEvents+" AND name_hash = name_hash(?) AND date = ? LIMIT 1",
+			func(s *sqlite.Stmt) error {
+				exists = true
+				return nil
+			},
+			owner,
+			e.name,
+			e.date)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if exists {
+			skipped++
+			continue
+		}
+
+		if err = insertEvent(connection, owner, author, e.name, e.date); err != nil {
+			return 0, 0, err
+		}
+
+		imported++
+	}
+
+	return imported, skipped, nil
+}
+
+// importError is when the file can't be imported, like when it's broken.
+// Unlike the database errors it's fine to show it to the user.
+type importError struct {
+	err error
+}
+
+func (e importError) Error() string {
+	return e.err.Error()
+}
+
+// Parses the file with the importer and stores the events. The owner is the
+// user or the shared group, the author is who imports.
+func importEvents(connection *sqlite.Conn, owner int, author int, i importer, r io.Reader) (importResult, error) {
+	events, invalid, err := i.parse(r)
+	if err != nil {
+		return importResult{}, importError{err}
+	}
+
+	// Nothing is imported when any of it can't be
+	for _, e := range events {
+		readOnly, err := isReadOnly(connection, owner, e.name)
+		if err != nil {
+			return importResult{}, err
+		}
+
+		if readOnly {
+			return importResult{}, importError{fmt.Errorf("'%s' is shared with you to view only, it can't be imported", e.name)}
+		}
+	}
+
+	imported, skipped, err := storeImportedEvents(connection, owner, author, events)
+	if err != nil {
+		return importResult{}, err
+	}
+
+	return importResult{imported: imported, skipped: skipped, invalid: invalid}, nil
+}
+
+func (r importResult) String() string {
+	response := strings.Builder{}
+	response.WriteString(fmt.Sprintf(
+		"Imported %d events, skipped %d duplicates, found %d invalid rows",
+		r.imported,
+		r.skipped,
+		len(r.invalid)))
+
+	if len(r.invalid) > 0 {
+		rows := make([]string, 0, maxReportedInvalids)
+		for i, row := range r.invalid {
+			if i >= maxReportedInvalids {
+				rows = append(rows, "...")
+				break
+			}
+			rows = append(rows, fmt.Sprint(row))
+		}
+
+		response.WriteString(fmt.Sprintf("\nInvalid rows: %s", strings.Join(rows, ", ")))
+	}
+
+	return response.String()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseWith(t *testing.T, format string, options string, content string) ([]importedEvent, []int) {
+	i, err := newImporter(format, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, invalid, err := i.parse(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return events, invalid
+}
+
+func TestExportCSVImporter(t *testing.T) {
+	date := func(s string) int64 {
+		d, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Unix()
+	}
+
+	tests := []struct {
+		content string
+		events  []importedEvent
+		invalid []int
+	}{
+		{
+			"coffee,2026-01-02T08:00:00Z\n\"green, tea\",2026-01-02T09:30:00+01:00\n",
+			[]importedEvent{{"coffee", date("2026-01-02T08:00:00Z")}, {"green, tea", date("2026-01-02T08:30:00Z")}},
+			[]int{},
+		},
+		{
+			"name,date\ncoffee,2026-01-02T08:00:00Z\n",
+			[]importedEvent{{"coffee", date("2026-01-02T08:00:00Z")}},
+			[]int{},
+		},
+		{
+			"coffee,yesterday\n,2026-01-02T08:00:00Z\ncoffee\ntea,2026-01-02T08:00:00Z,extra\nbeer,2026-01-03T20:00:00Z\n",
+			[]importedEvent{{"beer", date("2026-01-03T20:00:00Z")}},
+			[]int{1, 2, 3, 4},
+		},
+		{
+			"",
+			[]importedEvent{},
+			[]int{},
+		},
+	}
+
+	for _, test := range tests {
+		events, invalid := parseWith(t, "since", "", test.content)
+		if !reflect.DeepEqual(events, test.events) || !reflect.DeepEqual(invalid, test.invalid) {
+			t.Errorf("%q: got %v %v, want %v %v", test.content, events, invalid, test.events, test.invalid)
+		}
+	}
+}
+
+func TestGenericCSVImporter(t *testing.T) {
+	tests := []struct {
+		options string
+		content string
+		events  []importedEvent
+		invalid []int
+	}{
+		{
+			"",
+			"2026-01-02T08:00:00Z,coffee\nyesterday,tea\n2026-01-02T09:00:00Z,\n",
+			[]importedEvent{{"coffee", 1767340800}},
+			[]int{2, 3},
+		},
+		{
+			"date=2 name=1 format=unix",
+			"coffee,1767340800\ntea,soon\n",
+			[]importedEvent{{"coffee", 1767340800}},
+			[]int{2},
+		},
+		{
+			"format=unixms sep=;",
+			"1767340800123;coffee\n",
+			[]importedEvent{{"coffee", 1767340800}},
+			[]int{},
+		},
+		{
+			"date=When name=What format=unix",
+			"What,When\ncoffee,1767340800\nshort\n",
+			[]importedEvent{{"coffee", 1767340800}},
+			[]int{3},
+		},
+		{
+			`"format=2006-01-02 15:04 -0700" header=yes`,
+			"date,name\n2026-01-02 09:00 +0100,coffee\n",
+			[]importedEvent{{"coffee", 1767340800}},
+			[]int{},
+		},
+	}
+
+	for _, test := range tests {
+		events, invalid := parseWith(t, "csv", test.options, test.content)
+		if !reflect.DeepEqual(events, test.events) || !reflect.DeepEqual(invalid, test.invalid) {
+			t.Errorf("%s %q: got %v %v, want %v %v", test.options, test.content, events, invalid, test.events, test.invalid)
+		}
+	}
+}
+
+func TestGenericCSVImporterOptions(t *testing.T) {
+	tests := []struct {
+		options string
+		fails   bool
+	}{
+		{"", false},
+		{`sep=\t header=no`, false},
+		{"sep=;; ", true},
+		{"header=maybe", true},
+		{"color=red", true},
+		{"date", true},
+	}
+
+	for _, test := range tests {
+		if _, err := newImporter("csv", test.options); (err != nil) != test.fails {
+			t.Errorf("%s: got error %v", test.options, err)
+		}
+	}
+
+	// The named column must be in the header
+	i, _ := newImporter("csv", "date=When")
+	if _, _, err := i.parse(strings.NewReader("date,name\n")); err == nil {
+		t.Error("a missing column should fail the import")
+	}
+}
+
+func TestLoopImporter(t *testing.T) {
+	noon := func(year int, month time.Month, day int) int64 {
+		return time.Date(year, month, day, loopEventHour, 0, 0, 0, time.Local).Unix()
+	}
+
+	tests := []struct {
+		content string
+		events  []importedEvent
+		invalid []int
+	}{
+		{
+			"Date,Run,Read\n2026-01-02,2,0\n2026-01-01,1,2\n",
+			[]importedEvent{{"Run", noon(2026, time.January, 2)}, {"Read", noon(2026, time.January, 1)}},
+			[]int{},
+		},
+		{
+			// Unknown, skipped and empty days are not events
+			"Date,Run\n2026-01-03,-1\n2026-01-02,3\n2026-01-01,\n",
+			[]importedEvent{},
+			[]int{},
+		},
+		{
+			// The numerical habits and the broken rows are invalid
+			"Date,Run,Pages\n2026-01-02,2,12000\nyesterday,2,0\n2026-01-01,2,0,0\n2025-12-31,2,0\n",
+			[]importedEvent{{"Run", noon(2025, time.December, 31)}},
+			[]int{2, 3, 4},
+		},
+	}
+
+	for _, test := range tests {
+		events, invalid := parseWith(t, "loop", "", test.content)
+		if !reflect.DeepEqual(events, test.events) || !reflect.DeepEqual(invalid, test.invalid) {
+			t.Errorf("%q: got %v %v, want %v %v", test.content, events, invalid, test.events, test.invalid)
+		}
+	}
+}
+
+// The imported events go where the logged ones would
+func TestImportEventsIntoTrackers(t *testing.T) {
+	db := openTestDB(t, testData{
+		trackers: []testTracker{
+			{7, "walk", []testMember{{2, ownerRole}, {1, memberRole}}},
+			{8, "feeding", []testMember{{2, ownerRole}, {1, viewerRole}}},
+		},
+		events: []testEvent{{tracker: 7, author: 2, name: "walk", date: 10}},
+	})
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	i, err := newImporter("since", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The walk at 10 is already there, logged by the other member
+	content := "walk,1970-01-01T00:00:10Z\nwalk,1970-01-01T00:00:20Z\ncoffee,1970-01-01T00:00:20Z\n"
+	result, err := importEvents(connection, 1, 1, i, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.imported != 2 || result.skipped != 1 {
+		t.Errorf("got %+v", result)
+	}
+
+	// Nothing at all when one of the events is only for viewing
+	content = "coffee,1970-01-01T00:00:30Z\nfeeding,1970-01-01T00:00:30Z\n"
+	if _, err := importEvents(connection, 1, 1, i, strings.NewReader(content)); err == nil {
+		t.Error("imported into the tracker the user only views")
+	} else if _, ok := err.(importError); !ok {
+		t.Errorf("got %v", err)
+	}
+
+	tests := []struct {
+		query string
+		count int
+	}{
+		{"SELECT COUNT(*) FROM events WHERE tracker = 7 AND user IS NULL", 2},
+		{"SELECT COUNT(*) FROM events WHERE tracker = 7 AND author = 1 AND date = 20", 1},
+		{"SELECT COUNT(*) FROM events WHERE user = 1 AND author = 1 AND tracker IS NULL", 1},
+		{"SELECT COUNT(*) FROM events WHERE date = 30", 0},
+	}
+
+	for _, test := range tests {
+		count, err := countRows(connection, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != test.count {
+			t.Errorf("%s: got %d, want %d", test.query, count, test.count)
+		}
+	}
+}
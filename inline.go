@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	maxInlineResults = 20
+
+	// Telegram keeps the results for the same user and query this long, and
+	// the bot keeps the user's names
+	inlineCacheSeconds = 5
+
+	// The ID of the result that creates a new event named as the query
+	newInlineResultID = "new"
+)
+
+// Answers with the user's events that start with the query, the most frequent
+// first. When nothing matches offers to log the query as a new event.
+func (c context) answerInline() error {
+	query := strings.TrimSpace(c.inlineQuery.Query)
+
+	events, err := c.inlineEvents()
+	if err != nil {
+		return err
+	}
+
+	now := int64(c.message.Date)
+	results := []interface{}{}
+	exact := false
+	for _, e := range matchPrefix(events, query, maxInlineResults) {
+		article := tgbotapi.NewInlineQueryResultArticle(
+			strconv.FormatInt(e.lastID, 10),
+			e.name,
+			fmt.Sprintf("Logged '%s'", e.name))
+		article.Description = formatResponse(e.name, now, e.lastDate)
+		results = append(results, article)
+
+		if normalizeName(e.name) == normalizeName(query) {
+			exact = true
+		}
+	}
+
+	if query != "" && !exact {
+		article := tgbotapi.NewInlineQueryResultArticle(
+			newInlineResultID,
+			query,
+			fmt.Sprintf("Logged '%s'", query))
+		article.Description = fmt.Sprintf("First time for '%s'", query)
+		results = append(results, article)
+	}
+
+	return c.answerInlineResults(results)
+}
+
+// Every key press is a new query, they all search the same names
+func (c context) inlineEvents() ([]matchedEvent, error) {
+	now := time.Now()
+	if events, ok := inlineNames.get(c.owner, now); ok {
+		return events, nil
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	events, err := loadInlineEvents(connection, c.owner)
+	if err != nil {
+		return nil, err
+	}
+
+	inlineNames.put(c.owner, events, now)
+
+	return events, nil
+}
+
+func (c context) answerInlineResults(results []interface{}) error {
+	c.logger().Debug("Answering the inline query", "results", len(results))
+
+	if debugChartEnabled || c.bot == nil {
+		return nil
+	}
+
+	_, err := c.bot.AnswerInlineQuery(tgbotapi.InlineConfig{
+		InlineQueryID: c.inlineQuery.ID,
+		Results:       results,
+		CacheTime:     inlineCacheSeconds,
+		IsPersonal:    true,
+	})
+
+	return err
+}
+
+// The user picked one of the results. The result ID refers to an event with
+// the same name, the names might not fit into the ID.
+func (c context) logChosenInline() error {
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	userID := c.owner
+	name := strings.TrimSpace(c.chosenResult.Query)
+
+	if c.chosenResult.ResultID != newInlineResultID {
+		eventID, err := strconv.ParseInt(c.chosenResult.ResultID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid inline result ID '%s'", c.chosenResult.ResultID)
+		}
+
+		name, err = eventNameByID(connection, userID, eventID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Deleted in the meantime, nothing to tell the user either, there's no chat
+	if name == "" {
+		return nil
+	}
+
+	readOnly, err := isReadOnly(connection, userID, name)
+	if err != nil || readOnly {
+		return err
+	}
+
+	err = c.storeEvent(connection, name, int64(c.message.Date))
+	inlineNames.forget(userID)
+
+	return err
+}
+
+type matchedEvent struct {
+	name     string
+	lastID   int64
+	lastDate int64
+}
+
+// All the user's events, the most frequent first. The names are decrypted, so
+// it's one pass over the user's events for all the key presses in a row.
+func loadInlineEvents(connection *sqlite.Conn, userID int) ([]matchedEvent, error) {
+	events := []matchedEvent{}
+	err := sqlitex.Exec(
+		connection,
+		"SELECT decrypt_name(name) name, MAX(id) last_id, MAX(date) last_date, COUNT(*) freq FROM events "+
+			"WHERE "+visibleEvents+" "+
+			"GROUP BY name_hash "+
+			"ORDER BY freq DESC, last_date DESC;",
+		func(s *sqlite.Stmt) error {
+			events = append(events, matchedEvent{
+				name:     s.GetText("name"),
+				lastID:   s.GetInt64("last_id"),
+				lastDate: s.GetInt64("last_date"),
+			})
+			return nil
+		},
+		userID)
+
+	return events, err
+}
+
+// Case insensitive prefix search, keeps the order
+func matchPrefix(events []matchedEvent, prefix string, limit int) []matchedEvent {
+	prefix = strings.ToLower(prefix)
+
+	matched := []matchedEvent{}
+	for _, e := range events {
+		if len(matched) >= limit {
+			break
+		}
+
+		if strings.HasPrefix(strings.ToLower(e.name), prefix) {
+			matched = append(matched, e)
+		}
+	}
+
+	return matched
+}
+
+// inlineCache keeps the names of the users who type inline for a few seconds,
+// like Telegram does with the results. The names are decrypted, so they're
+// not kept any longer than that.
+type inlineCache struct {
+	mutex sync.Mutex
+	users map[int]inlineCacheEntry
+}
+
+type inlineCacheEntry struct {
+	events []matchedEvent
+	loaded time.Time
+}
+
+var inlineNames = newInlineCache()
+
+func newInlineCache() *inlineCache {
+	return &inlineCache{users: map[int]inlineCacheEntry{}}
+}
+
+func (c *inlineCache) get(userID int, now time.Time) ([]matchedEvent, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.users[userID]
+	if !ok || now.Sub(entry.loaded) >= inlineCacheSeconds*time.Second {
+		return nil, false
+	}
+
+	return entry.events, true
+}
+
+// Drops the stale ones on the way, there's never more than a few
+func (c *inlineCache) put(userID int, events []matchedEvent, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for id, entry := range c.users {
+		if now.Sub(entry.loaded) >= inlineCacheSeconds*time.Second {
+			delete(c.users, id)
+		}
+	}
+
+	c.users[userID] = inlineCacheEntry{events: events, loaded: now}
+}
+
+// The counts change once something is logged
+func (c *inlineCache) forget(userID int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.users, userID)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchPrefix(t *testing.T) {
+	events := []matchedEvent{{name: "coffee"}, {name: "Cola"}, {name: "tea"}, {name: "cocoa"}}
+
+	tests := []struct {
+		prefix string
+		limit  int
+		want   string
+	}{
+		{"co", 10, "coffee,Cola,cocoa"},
+		{"CO", 10, "coffee,Cola,cocoa"},
+		{"co", 2, "coffee,Cola"},
+		{"", 10, "coffee,Cola,tea,cocoa"},
+		{"water", 10, ""},
+	}
+
+	for _, test := range tests {
+		names := []string{}
+		for _, e := range matchPrefix(events, test.prefix, test.limit) {
+			names = append(names, e.name)
+		}
+
+		if got := strings.Join(names, ","); got != test.want {
+			t.Errorf("'%s' up to %d: got '%s', want '%s'", test.prefix, test.limit, got, test.want)
+		}
+	}
+}
+
+func TestInlineCache(t *testing.T) {
+	cache := newInlineCache()
+	start := time.Unix(1000, 0)
+	events := []matchedEvent{{name: "coffee"}}
+
+	if _, ok := cache.get(1, start); ok {
+		t.Error("found before it's put")
+	}
+
+	cache.put(1, events, start)
+	if got, ok := cache.get(1, start.Add(time.Second)); !ok || len(got) != 1 {
+		t.Error("not found right after it's put")
+	}
+
+	if _, ok := cache.get(2, start.Add(time.Second)); ok {
+		t.Error("found for another user")
+	}
+
+	if _, ok := cache.get(1, start.Add(inlineCacheSeconds*time.Second)); ok {
+		t.Error("found after it's expired")
+	}
+
+	cache.forget(1)
+	if _, ok := cache.get(1, start.Add(time.Second)); ok {
+		t.Error("found after it's forgotten")
+	}
+
+	// The stale ones go when a new one is put
+	cache.put(1, events, start)
+	cache.put(2, events, start.Add(time.Minute))
+	if len(cache.users) != 1 {
+		t.Errorf("got %d users, want 1", len(cache.users))
+	}
+}
+
+func TestLoadInlineEvents(t *testing.T) {
+	data := testData{trackers: []testTracker{{7, "walk", []testMember{{1, memberRole}}}}}
+	for i, name := range []string{"coffee", "tea", "tea", "coffee", "walk", "walk", "walk"} {
+		e := testEvent{user: 1, author: 1, name: name, date: int64(i)}
+		if name == "walk" {
+			e = testEvent{tracker: 7, author: 2, name: name, date: int64(i)}
+		}
+		data.events = append(data.events, e)
+	}
+	data.events = append(data.events, testEvent{user: 2, author: 2, name: "pizza", date: 10})
+
+	db := openTestDB(t, data)
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	events, err := loadInlineEvents(connection, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The most frequent first, the newer one first on a tie. Not the others'.
+	names := []string{}
+	for _, e := range events {
+		names = append(names, e.name)
+	}
+
+	if got := strings.Join(names, ","); got != "walk,coffee,tea" {
+		t.Errorf("got '%s'", got)
+	}
+
+	if events[0].lastID != 7 || events[0].lastDate != 6 {
+		t.Errorf("got %+v", events[0])
+	}
+}
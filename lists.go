@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	listPageSize    = 20
+	historyPageSize = 20
+
+	listTimeLayout = "2006-01-02 15:04"
+
+	listCallbackPrefix    = "list:"
+	historyCallbackPrefix = "hist:"
+)
+
+// How /list can be sorted, the first letter works too
+var listOrders = map[string]string{
+	"name":     "name COLLATE NOCASE ASC",
+	"recent":   "last_date DESC",
+	"frequent": "freq DESC, name COLLATE NOCASE ASC",
+}
+
+func (c context) list(args string) error {
+	order, ok := parseListOrder(args)
+	if !ok {
+		return c.sendMarkdown("Please pick the order: /list *[name|recent|frequent]*")
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	text, buttons, err := listPage(connection, c.owner, order, 0)
+	if err != nil {
+		return err
+	}
+
+	return c.sendPage(text, buttons)
+}
+
+func (c context) history(name string) error {
+	if name == "" {
+		return c.sendMarkdown("Please provide a name: /history *name*")
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	// The pages refer to the name by the event ID, the name might not fit
+	eventID, err := lastEventID(connection, c.owner, name)
+	if err != nil {
+		return err
+	}
+
+	if eventID == 0 {
+		return c.sendText(fmt.Sprintf("You don't have any events named '%s'", name))
+	}
+
+	text, buttons, err := historyPage(connection, c.owner, name, eventID, 0, c.memberNames())
+	if err != nil {
+		return err
+	}
+
+	return c.sendPage(text, buttons)
+}
+
+// Defaults to the most recent first
+func parseListOrder(args string) (string, bool) {
+	arg := strings.ToLower(strings.TrimSpace(args))
+	if arg == "" {
+		return "recent", true
+	}
+
+	for order := range listOrders {
+		if order == arg || order[:1] == arg {
+			return order, true
+		}
+	}
+
+	return "", false
+}
+
+// The names with the counts and the last dates
+func listPage(connection *sqlite.Conn, userID int, order string, page int) (string, []tgbotapi.InlineKeyboardButton, error) {
+	total, err := countRows(connection, "SELECT COUNT(DISTINCT name_hash) FROM events WHERE "+visibleEvents+";", userID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if total == 0 {
+		return "You don't have any events yet", nil, nil
+	}
+
+	page = clamp(page, 0, lastPage(total, listPageSize))
+
+	text := strings.Builder{}
+	fmt.Fprintf(&text, "Your events by %s (%d)%s:\n\n", order, total, pageNumber(page, total, listPageSize))
+
+	err = sqlitex.Exec(
+		connection,
+		"SELECT decrypt_name(name) name, COUNT(*) freq, MAX(date) last_date FROM events "+
+			"WHERE "+visibleEvents+" "+
+			"GROUP BY name_hash "+
+			"ORDER BY "+listOrders[order]+" "+
+			"LIMIT ? OFFSET ?;",
+		func(s *sqlite.Stmt) error {
+			fmt.Fprintf(
+				&text,
+				"%s - %d, last on %s\n",
+				s.GetText("name"),
+				s.GetInt64("freq"),
+				time.Unix(s.GetInt64("last_date"), 0).Format(listTimeLayout))
+			return nil
+		},
+		userID,
+		listPageSize,
+		page*listPageSize)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	buttons := pageButtons(page, total, listPageSize, func(page int) string {
+		return fmt.Sprintf("%s%s:%d", listCallbackPrefix, order, page)
+	})
+
+	return text.String(), buttons, nil
+}
+
+// The times of the events with the name, the newest first. Who logged it is
+// only shown when it's not the user, in the groups and the shared trackers.
+func historyPage(connection *sqlite.Conn, userID int, name string, eventID int64, page int, authorName func(userID int) string) (string, []tgbotapi.InlineKeyboardButton, error) {
+	total, err := countRows(connection, "SELECT COUNT(*) FROM events WHERE "+visibleEvents+" AND name_hash = name_hash(?);", userID, name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if total == 0 {
+		return fmt.Sprintf("You don't have any events named '%s'", name), nil, nil
+	}
+
+	page = clamp(page, 0, lastPage(total, historyPageSize))
+
+	text := strings.Builder{}
+	fmt.Fprintf(&text, "'%s' (%d)%s:\n\n", name, total, pageNumber(page, total, historyPageSize))
+
+	err = sqlitex.Exec(
+		connection,
+		"SELECT COALESCE(author, user) author, date FROM events "+
+			"WHERE "+visibleEvents+" AND name_hash = name_hash(?) "+
+			"ORDER BY date DESC LIMIT ? OFFSET ?;",
+		func(s *sqlite.Stmt) error {
+			text.WriteString(time.Unix(s.GetInt64("date"), 0).Format(listTimeLayout))
+			if author := int(s.GetInt64("author")); author != userID {
+				text.WriteString(" - " + authorName(author))
+			}
+			text.WriteString("\n")
+			return nil
+		},
+		userID,
+		name,
+		historyPageSize,
+		page*historyPageSize)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	buttons := pageButtons(page, total, historyPageSize, func(page int) string {
+		return fmt.Sprintf("%s%d:%d", historyCallbackPrefix, eventID, page)
+	})
+
+	return text.String(), buttons, nil
+}
+
+// "list:recent:2" from the prev/next buttons
+func (c context) listPageCallback(arg string) error {
+	order, pageArg := splitCallbackArg(arg)
+	page, err := strconv.Atoi(pageArg)
+	if _, ok := listOrders[order]; !ok || err != nil {
+		return c.answerCallback("This button doesn't work anymore")
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	text, buttons, err := listPage(connection, c.owner, order, page)
+	if err != nil {
+		return err
+	}
+
+	if err := c.answerCallback(""); err != nil {
+		return err
+	}
+
+	return c.editPage(text, buttons)
+}
+
+// "hist:123:2" from the prev/next buttons
+func (c context) historyPageCallback(arg string) error {
+	idArg, pageArg := splitCallbackArg(arg)
+	eventID, idErr := strconv.ParseInt(idArg, 10, 64)
+	page, pageErr := strconv.Atoi(pageArg)
+	if idErr != nil || pageErr != nil {
+		return c.answerCallback("This button doesn't work anymore")
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	name, err := eventNameByID(connection, c.owner, eventID)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		return c.answerCallback("This event is gone")
+	}
+
+	text, buttons, err := historyPage(connection, c.owner, name, eventID, page, c.memberNames())
+	if err != nil {
+		return err
+	}
+
+	if err := c.answerCallback(""); err != nil {
+		return err
+	}
+
+	return c.editPage(text, buttons)
+}
+
+// The prev and next buttons where there's somewhere to go
+func pageButtons(page int, total int, pageSize int, callbackData func(page int) string) []tgbotapi.InlineKeyboardButton {
+	buttons := []tgbotapi.InlineKeyboardButton{}
+	if page > 0 {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData("« Prev", callbackData(page-1)))
+	}
+
+	if page < lastPage(total, pageSize) {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData("Next »", callbackData(page+1)))
+	}
+
+	return buttons
+}
+
+// ", page 2 of 5" or nothing when everything fits
+func pageNumber(page int, total int, pageSize int) string {
+	if total <= pageSize {
+		return ""
+	}
+
+	return fmt.Sprintf(", page %d of %d", page+1, lastPage(total, pageSize)+1)
+}
+
+func lastPage(total int, pageSize int) int {
+	if total == 0 {
+		return 0
+	}
+
+	return (total - 1) / pageSize
+}
+
+func (c context) sendPage(text string, buttons []tgbotapi.InlineKeyboardButton) error {
+	if len(buttons) == 0 {
+		return c.sendText(text)
+	}
+
+	return c.sendInlineKeyboard(text, buttons)
+}
+
+func (c context) editPage(text string, buttons []tgbotapi.InlineKeyboardButton) error {
+	if len(buttons) == 0 {
+		return c.editText(text)
+	}
+
+	keyboard := newInlineKeyboard(buttons)
+	return c.editTextWithKeyboard(text, &keyboard)
+}
+
+// "a:b" -> "a", "b"
+func splitCallbackArg(arg string) (string, string) {
+	if i := strings.LastIndex(arg, ":"); i >= 0 {
+		return arg[:i], arg[i+1:]
+	}
+
+	return arg, ""
+}
+
+func countRows(connection *sqlite.Conn, query string, args ...interface{}) (int, error) {
+	count := 0
+	err := sqlitex.Exec(
+		connection,
+		query,
+		func(s *sqlite.Stmt) error {
+			count = s.ColumnInt(0)
+			return nil
+		},
+		args...)
+
+	return count, err
+}
+
+// The newest event with the name or 0 when there's none
+func lastEventID(connection *sqlite.Conn, userID int, name string) (int64, error) {
+	var id int64
+	err := sqlitex.Exec(
+		connection,
+		"SELECT MAX(id) FROM events WHERE "+visibleEvents+" AND name_hash = name_hash(?);",
+		func(s *sqlite.Stmt) error {
+			id = s.ColumnInt64(0)
+			return nil
+		},
+		userID,
+		name)
+
+	return id, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	jsonLogFormat   = "json"
+	logfmtLogFormat = "logfmt"
+
+	// Enough to tell the names apart in the logs
+	redactedHashLength = 8
+)
+
+// Whether the event names and the other user texts go to the logs as is.
+// Set once at the start from the config.
+var logUserTexts = false
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// Replaces the default logger, the standard log package goes through it too
+func setupLogging(config LogConfig) {
+	options := &slog.HandlerOptions{Level: logLevels[strings.ToLower(config.Level)]}
+
+	var handler slog.Handler
+	if config.Format == jsonLogFormat {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	logUserTexts = config.ShowUserTexts
+}
+
+// Random for every run. With a plain hash the short names could be found by
+// hashing the guesses.
+var redactKey = newRedactKey()
+
+func newRedactKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("Failed to generate the log redaction key: %v", err))
+	}
+
+	return key
+}
+
+// The event names and notes are private. By default only a keyed hash goes to
+// the logs, the same name gets the same hash until the restart, so it's still
+// possible to follow it around.
+func redact(text string) string {
+	if logUserTexts || text == "" {
+		return text
+	}
+
+	mac := hmac.New(sha256.New, redactKey)
+	mac.Write([]byte(text))
+	return "#" + hex.EncodeToString(mac.Sum(nil))[:redactedHashLength]
+}
+
+// Logger with the update details attached
+func (c context) logger() *slog.Logger {
+	userID := 0
+	if c.message != nil && c.message.From != nil {
+		userID = c.message.From.ID
+	}
+
+	return slog.With(
+		"update_id", c.updateID,
+		"user_id", userID,
+		"command", c.command())
+}
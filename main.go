@@ -1,19 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
-	"encoding/csv"
-	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"crawshaw.io/sqlite"
@@ -28,31 +32,44 @@ const (
 	defaultMonthChartDays = 30
 	defaultYearChartWeeks = 52
 
+	maxChartDays = 366
+
+	minCompareCount = 2
+	maxCompareCount = 6
+
+	defaultQuickCount = 8
+	maxQuickCount     = 24
+
 	defaultTopCount = 10
 	minTopCount     = 3
 	maxTopCount     = 25
+
+	hoursPerDay = 24
+
+	dbPoolSize = 16
+
+	pollRetryInterval = 3 * time.Second
 )
 
+var weekdayLabels = []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+
 //
 // Debug
 //
 
 const (
-	debugSendPanicToChat = false
-	debugChartFilename   = "debug.png"
+	debugChartFilename = "debug.png"
 )
 
 // When `debugChartEnabled` is true, the chars are rendered to the local `debug.png`
 // and the process exits. See `make debug-chart`.
 var debugChartEnabled = os.Getenv("SINCE_BOT_DEBUG_CHART") == "1"
 
-func savePng(content []byte) {
-	if err := ioutil.WriteFile(debugChartFilename, content, 0644); err != nil {
-		log.Panic(err)
-	}
+func savePng(content []byte) error {
+	return ioutil.WriteFile(debugChartFilename, content, 0644)
 }
 
-func saveRedPng() {
+func saveRedPng() error {
 	// Red PNG 100x100
 	pngB64 := "iVBORw0KGgoAAAANSUhEUgAAAGQAAABkCAYAAABw4pVUAAAApElEQVR42u3R" +
 		"AQ0AAAjDMO5fNCCDkC5z0HTVrisFCBABASIgQAQEiIAAAQJEQIAICBABASIgQAREQI" +
@@ -60,39 +77,13 @@ func saveRedPng() {
 		"CBABASIgQAREQIAICBABASIgQAREQIAICBABASIgQAREQIAICBABASIgQAQECBAgAg" +
 		"JEQIAIyPcGFY7HnV2aPXoAAAAASUVORK5CYII="
 	pngBin, _ := base64.StdEncoding.DecodeString(pngB64)
-	savePng(pngBin)
+	return savePng(pngBin)
 }
 
 //
 // Utils
 //
 
-// Config represents the structure of the config.json file
-type Config struct {
-	Token string `json:"token"`
-}
-
-func readConfig() Config {
-	file, err := os.Open("config.json")
-	if err != nil {
-		log.Panic(err)
-	}
-
-	defer file.Close()
-	bytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	var config Config
-	err = json.Unmarshal(bytes, &config)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	return config
-}
-
 func formatResponse(name string, date int64, prevDate int64) string {
 	prev := time.Unix(prevDate, 0)
 	now := time.Unix(date, 0)
@@ -100,13 +91,13 @@ func formatResponse(name string, date int64, prevDate int64) string {
 	return fmt.Sprintf("%s since last '%s'", duration, name)
 }
 
-func buildSinceResponse(name string, now int64, userID int64, connection *sqlite.Conn) string {
+func buildSinceResponse(name string, now int64, userID int64, connection *sqlite.Conn) (string, error) {
 	response := ""
 
 	// Get the last event with the same name and format the response
 	err := sqlitex.Exec(connection,
 		"SELECT date FROM events "+
-			"WHERE user = ? AND name = ? "+
+			"WHERE "+visibleEvents+" AND name_hash = name_hash(?) "+
 			"ORDER BY date "+
 			"DESC LIMIT 1",
 		func(s *sqlite.Stmt) error {
@@ -116,11 +107,7 @@ func buildSinceResponse(name string, now int64, userID int64, connection *sqlite
 		userID,
 		name)
 
-	if err != nil {
-		log.Panic(err)
-	}
-
-	return response
+	return response, err
 }
 
 //
@@ -128,64 +115,186 @@ func buildSinceResponse(name string, now int64, userID int64, connection *sqlite
 //
 
 type context struct {
-	message *tgbotapi.Message
-	db      *sqlitex.Pool
-	bot     *tgbotapi.BotAPI
+	updateID int
+	message  *tgbotapi.Message
+	db       *sqlitex.Pool
+	bot      *tgbotapi.BotAPI
+	sender   *sender
+	jobs     *scheduler
+	config   Config
+
+	// Whose events these are: the user's or the chat's, when it's a shared
+	// group. Set in dispatch.
+	owner int
+
+	// Set when a button is pressed or the bot is used inline. The message is
+	// made up then.
+	callback     *tgbotapi.CallbackQuery
+	inlineQuery  *tgbotapi.InlineQuery
+	chosenResult *tgbotapi.ChosenInlineResult
+}
+
+func newContext(update tgbotapi.Update, db *sqlitex.Pool, bot *tgbotapi.BotAPI, sender *sender, jobs *scheduler, config Config) context {
+	c := context{updateID: update.UpdateID, message: update.Message, db: db, bot: bot, sender: sender, jobs: jobs, config: config}
+
+	switch {
+	case update.CallbackQuery != nil:
+		c.callback = update.CallbackQuery
+		c.message = callbackMessage(update.CallbackQuery)
+	case update.InlineQuery != nil:
+		c.inlineQuery = update.InlineQuery
+		c.message = userMessage(update.InlineQuery.From)
+	case update.ChosenInlineResult != nil:
+		c.chosenResult = update.ChosenInlineResult
+		c.message = userMessage(update.ChosenInlineResult.From)
+	}
+
+	return c
+}
+
+func (c context) command() string {
+	return updateCommand(tgbotapi.Update{
+		Message:            c.message,
+		CallbackQuery:      c.callback,
+		InlineQuery:        c.inlineQuery,
+		ChosenInlineResult: c.chosenResult,
+	})
+}
+
+// All the messages should go through here to stay within the Telegram limits
+func (c context) send(chatID int64, message tgbotapi.Chattable) error {
+	var err error
+	if c.sender == nil {
+		_, err = c.bot.Send(message)
+	} else {
+		_, err = c.sender.send(chatID, message)
+	}
+
+	if err != nil {
+		observeSendError(err)
+	}
+
+	return err
 }
 
-func (c context) sendResponse(response string, format string) {
-	log.Printf("Responding to '%s' in '%s' with '%s'", c.message.From, format, response)
+func (c context) sendResponse(response string, format string) error {
+	c.logger().Debug("Responding", "format", format, "text", redact(response))
 
 	if debugChartEnabled {
-		saveRedPng()
-		return
+		return saveRedPng()
 	}
 
 	message := tgbotapi.NewMessage(c.message.Chat.ID, response)
 	message.ParseMode = format
 
-	_, err := c.bot.Send(message)
-	if err != nil {
-		log.Panic(err)
-	}
+	return c.send(c.message.Chat.ID, message)
+}
+
+// The time the message was sent at, in the time zone of the charts
+func (c context) now() time.Time {
+	return time.Unix(int64(c.message.Date), 0).In(c.config.Charts.location())
 }
 
-func (c context) sendText(response string) {
-	c.sendResponse(response, "")
+func (c context) sendText(response string) error {
+	return c.sendResponse(response, "")
 }
 
-func (c context) sendMarkdown(response string) {
-	c.sendResponse(response, "Markdown")
+func (c context) sendMarkdown(response string) error {
+	return c.sendResponse(response, "Markdown")
 }
 
-func (c context) sendImage(filename string, content []byte) {
-	log.Printf("Sending an image named '%s' to '%s'", filename, c.message.From)
+func (c context) sendImage(filename string, content []byte) error {
+	c.logger().Debug("Sending an image", "filename", filename)
 
 	if debugChartEnabled {
-		saveRedPng()
-		return
+		return saveRedPng()
 	}
 
 	image := tgbotapi.FileBytes{Name: filename, Bytes: content}
-	_, err := c.bot.Send(tgbotapi.NewPhotoUpload(c.message.Chat.ID, image))
-	if err != nil {
-		log.Panic(err)
-	}
+	return c.send(c.message.Chat.ID, tgbotapi.NewPhotoUpload(c.message.Chat.ID, image))
 }
 
-func (c context) sendFile(filename string, content []byte) {
-	log.Printf("Sending a file named '%s' to '%s'", filename, c.message.From)
+func (c context) sendFile(filename string, content []byte) error {
+	c.logger().Debug("Sending a file", "filename", filename)
 
 	if debugChartEnabled {
-		saveRedPng()
-		return
+		return saveRedPng()
 	}
 
 	file := tgbotapi.FileBytes{Name: filename, Bytes: content}
-	_, err := c.bot.Send(tgbotapi.NewDocumentUpload(c.message.Chat.ID, file))
+	return c.send(c.message.Chat.ID, tgbotapi.NewDocumentUpload(c.message.Chat.ID, file))
+}
+
+func (c context) downloadFile(fileID string, maxSize int64) ([]byte, error) {
+	c.logger().Debug("Downloading a file", "file_id", fileID)
+
+	url, err := c.bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to download '%s': %s", fileID, response.Status)
+	}
+
+	// The size in the message is not always there, one byte over the limit
+	// tells the file is too big rather than cutting it
+	content, err := ioutil.ReadAll(io.LimitReader(response.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(content)) > maxSize {
+		return nil, errFileTooBig
+	}
+
+	return content, nil
+}
+
+// Writes the file to a temporary location first and uploads it from there, so
+// the whole file is never kept in memory
+func (c context) sendFileStream(filename string, write func(w io.Writer) error) error {
+	c.logger().Debug("Sending a streamed file", "filename", filename)
+
+	dir, err := ioutil.TempDir("", "since-bot")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+
+	// The file name is what the user sees
+	path := filepath.Join(dir, filename)
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+
+	if debugChartEnabled {
+		return saveRedPng()
 	}
+
+	return c.send(c.message.Chat.ID, tgbotapi.NewDocumentUpload(c.message.Chat.ID, path))
 }
 
 // This interface unites all the charts
@@ -193,29 +302,32 @@ type renderableChart interface {
 	Render(rp chart.RendererProvider, w io.Writer) error
 }
 
-func (c context) sendChart(ch renderableChart) {
+func (c context) sendChart(ch renderableChart) error {
 	// Render
+	started := time.Now()
 	buffer := &bytes.Buffer{}
 	err := ch.Render(chart.PNG, buffer)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
+	chartRenderDuration.Observe(time.Since(started).Seconds())
+	chartBytes.Observe(float64(buffer.Len()))
+
 	if debugChartEnabled {
 		// Save locally
-		savePng(buffer.Bytes())
-	} else {
-		// Send as photo
-		c.sendImage("chart.png", buffer.Bytes())
+		return savePng(buffer.Bytes())
 	}
+
+	// Send as photo
+	return c.sendImage("chart.png", buffer.Bytes())
 }
 
-func (c context) sendKeyboard(text string, names ...string) {
-	log.Printf("Sending a keyboard %v to '%s'", names, c.message.From)
+func (c context) sendKeyboard(text string, names ...string) error {
+	c.logger().Debug("Sending a keyboard", "size", len(names))
 
 	if debugChartEnabled {
-		saveRedPng()
-		return
+		return saveRedPng()
 	}
 
 	var markup interface{}
@@ -236,150 +348,420 @@ func (c context) sendKeyboard(text string, names ...string) {
 	message := tgbotapi.NewMessage(c.message.Chat.ID, text)
 	message.ReplyMarkup = markup
 
-	_, err := c.bot.Send(message)
-	if err != nil {
-		log.Panic(err)
-	}
+	return c.send(c.message.Chat.ID, message)
 }
 
 //
 // Commands
 //
 
-func (c context) add(text string) {
+func (c context) add(text string) error {
 	if text == "" {
-		c.sendText("Please provide a name: *name* or /add *name* if you'd like to be formal")
-		return
+		return c.sendText("Please provide a name: *name* or /add *name* if you'd like to be formal")
 	}
 
 	// DB
-	connection := c.db.Get(nil)
+	connection := getConnection(c.db)
 	defer c.db.Put(connection)
 
 	// Get stuff out the incoming message
 	name := text
 	date := int64(c.message.Date)
 
+	readOnly, err := isReadOnly(connection, c.owner, name)
+	if err != nil {
+		return err
+	}
+
+	if readOnly {
+		return c.sendText(fmt.Sprintf(readOnlyMessage, name))
+	}
+
 	// /add is /since + store
-	response := buildSinceResponse(name, date, int64(c.message.From.ID), connection)
+	response, err := buildSinceResponse(name, date, int64(c.owner), connection)
+	if err != nil {
+		return err
+	}
+
 	if response == "" {
+		// A typo is more likely than a new name this close to an existing one.
+		// The explicit /add is the way to say it's really new.
+		if !c.message.IsCommand() {
+			similar, err := findSimilarNames(connection, c.owner, name, 1, false)
+			if err != nil {
+				return err
+			}
+
+			if len(similar) > 0 {
+				return c.suggestNames(
+					fmt.Sprintf("There's no '%s' yet. Did you mean one of these? Tap to log it or send /add %s to start a new one.", name, name),
+					similar,
+					addCallbackData)
+			}
+		}
+
 		response = fmt.Sprintf("First time for '%s'", name)
 	}
 
 	// Launch this one in parallel with the database access right bellow this
-	go c.sendText(response)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.sendText(response)
+	}()
 
 	// Store the new item in the database
-	err := sqlitex.Exec(
+	err = c.storeEvent(connection, name, date)
+
+	// Wait for the response to be sent anyway
+	if sendErr := <-sent; err == nil {
+		err = sendErr
+	}
+
+	return err
+}
+
+// Stores the event and marks the update as processed in one transaction, so
+// the same update received again after a crash never adds a second event
+func (c context) storeEvent(connection *sqlite.Conn, name string, date int64) (err error) {
+	defer sqlitex.Save(connection)(&err)
+
+	if c.updateID != 0 {
+		marked, err := markUpdateProcessed(connection, c.updateID, c.now().Unix())
+		if err != nil {
+			return err
+		}
+
+		if !marked {
+			return nil
+		}
+	}
+
+	return insertEvent(connection, c.owner, c.message.From.ID, name, date)
+}
+
+// The owner is the user or the shared group, the author is who logged it. The
+// names of the shared trackers go to the trackers.
+func insertEvent(connection *sqlite.Conn, owner int, author int, name string, date int64) error {
+	tracker, role, err := findTracker(connection, owner, name)
+	if err != nil {
+		return err
+	}
+
+	if tracker == 0 {
+		return sqlitex.Exec(
+			connection,
+			"INSERT INTO events (user, author, name, name_hash, date) VALUES (?1, ?2, encrypt_name(?3), name_hash(?3), ?4);",
+			nil,
+			owner,
+			author,
+			name,
+			date)
+	}
+
+	if role == viewerRole {
+		return fmt.Errorf("The user %d can't log to the tracker %d", author, tracker)
+	}
+
+	return sqlitex.Exec(
 		connection,
-		"INSERT INTO events (user, name, date) VALUES (?, ?, ?);",
+		"INSERT INTO events (tracker, author, name, name_hash, date) VALUES (?1, ?2, encrypt_name(?3), name_hash(?3), ?4);",
 		nil,
-		c.message.From.ID,
+		tracker,
+		author,
 		name,
 		date)
+}
 
+func (c context) compare(args string) error {
+	list, r, err := splitNameAndRange(args, c.now(), lastDaysRange(c.now(), c.config.Charts.MonthDays))
 	if err != nil {
-		log.Panic(err)
+		return c.sendText(err.Error())
+	}
+
+	// Names with spaces could be separated by commas
+	var names []string
+	if strings.Contains(list, ",") {
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	} else {
+		names = strings.Fields(list)
+	}
+
+	if len(names) < minCompareCount || len(names) > c.config.Charts.MaxCompareCount {
+		return c.sendMarkdown(fmt.Sprintf(
+			"Please provide %d to %d names: /compare *name1* *name2* *[range]*",
+			minCompareCount,
+			c.config.Charts.MaxCompareCount))
+	}
+
+	numDays := r.numDays()
+	if numDays < 2 || numDays > c.config.Charts.MaxDays {
+		return c.sendText(fmt.Sprintf("Please pick a range from 2 to %d days long", c.config.Charts.MaxDays))
 	}
-}
 
-func (c context) export() {
 	// DB
-	connection := c.db.Get(nil)
+	connection := getConnection(c.db)
 	defer c.db.Put(connection)
 
-	// CSV writer
-	buffer := &bytes.Buffer{}
-	csv := csv.NewWriter(buffer)
+	// All the series share the same days, the oldest first
+	dates := make([]time.Time, numDays)
+	for i := range dates {
+		dates[i] = r.dayStart(numDays - 1 - i)
+	}
 
-	// This is most likely a rarely used command, so we use a non caching version
-	err := sqlitex.ExecTransient(
-		connection,
-		"SELECT name, date FROM events WHERE user = ? ORDER BY date",
-		func(s *sqlite.Stmt) error {
-			err := csv.Write([]string{
-				s.GetText("name"),
-				time.Unix(s.GetInt64("date"), 0).Format(time.RFC3339),
-			})
-			if err != nil {
-				log.Panic(err)
+	maxValue := 0
+	series := make([]chart.Series, len(names))
+	for i, name := range names {
+		days, err := getDailyCounts(connection, c.owner, name, r)
+		if err != nil {
+			return err
+		}
+
+		values := make([]float64, numDays)
+		for j, day := range days {
+			values[numDays-j-1] = float64(day)
+			if day > maxValue {
+				maxValue = day
 			}
-			return nil
-		},
-		c.message.From.ID)
+		}
 
-	if err != nil {
-		log.Panic(err)
+		series[i] = chart.TimeSeries{
+			Name: name,
+			Style: chart.Style{
+				Show:        true,
+				StrokeWidth: 2,
+				StrokeColor: chart.GetDefaultColor(i),
+			},
+			XValues: dates,
+			YValues: values,
+		}
+	}
+
+	if maxValue == 0 {
+		return c.sendText(r.describe("None of these events have been logged"))
+	}
+
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = fmt.Sprintf("'%s'", name)
+	}
+
+	// Chart settings
+	response := chart.Chart{
+		Title:      r.describe(strings.Join(quoted, " vs ")),
+		TitleStyle: chart.StyleShow(),
+		Background: chart.Style{
+			Padding: chart.Box{
+				Top:  40,
+				Left: 20,
+			},
+		},
+		Width:  1024,
+		Height: 400,
+		XAxis: chart.XAxis{
+			Style:          chart.StyleShow(),
+			ValueFormatter: chart.TimeValueFormatterWithFormat("Jan 2"),
+		},
+		YAxis: chart.YAxis{
+			Style:          chart.StyleShow(),
+			ValueFormatter: chart.IntValueFormatter,
+			Range:          &chart.ContinuousRange{Min: 0, Max: float64(maxValue)},
+		},
+		Series: series,
 	}
+	response.Elements = []chart.Renderable{chart.Legend(&response)}
+
+	return c.sendChart(response)
+}
+
+func (c context) export(args string) error {
+	format, name := splitFirstWord(args)
+
+	// DB
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
 
-	// Never forget to flush when you're done
-	csv.Flush()
+	userID := c.owner
 
 	// There you go
-	c.sendFile("data.csv", buffer.Bytes())
+	switch strings.ToLower(format) {
+	case "", "csv":
+		return c.sendFileStream("data.csv", func(w io.Writer) error {
+			return writeEventsCSV(w, connection, userID, name)
+		})
+	case "json":
+		if name != "" {
+			return c.sendMarkdown("The JSON dump is everything at once. To get one event, please use /export csv *name* or /export ics *name*")
+		}
+
+		return c.sendFileStream("data.json", func(w io.Writer) error {
+			return writeJSONDump(w, connection, userID, c.now())
+		})
+	case "ics":
+		return c.sendFileStream("data.ics", func(w io.Writer) error {
+			return writeICalendar(w, connection, userID, name, c.now())
+		})
+	default:
+		return c.sendMarkdown("Please pick a format: /export *[csv|json|ics]*")
+	}
 }
 
-func (c context) help() {
-	c.sendMarkdown(`
+func (c context) help() error {
+	return c.sendMarkdown(`
 Simply send an event name to log a new event. This is equivalent to the /add command.
 
 Available commands are:
 
 /a, /add *name* - add a new event
-/e, /export - get all your data in CSV format
+/c, /compare *name1* *name2* *[...]* *[range]* - compare the daily activity of a few events
+/deleteme - delete everything the bot knows about you
+/e, /export *[csv|json|ics]* *[name]* - get all your data in CSV, iCalendar format or as a JSON dump of everything to keep. Only the events in the dump can be imported back.
+/forget *name* - delete all the events with the name
+/group *[on|off]* - in a group, whether the events belong to the group or to every member on their own
 /h, /help - this help message
-/m, /month *name* - disply some chart of event activity in the last month
+/hi, /history *name* - when the event was logged, the newest first
+/hr, /hours *name* *[range]* - chart of the time of day the event is logged at
+/i, /import *[format]* *[options]* - import a file produced by /export or another tracker, send it as a reply to the file or send the file with the format as the caption
+/l, /list *[name|recent|frequent]* - all your event names with the counts and the last dates
+/m, /month *name* *[range]* - disply some chart of event activity in the last month or *range*
+/pc, /punchcard *name* *[range]* - chart of the event activity by day of week and hour
+/q, /quick *[N]* - buttons to log one of the 8 or *N* most frequent events with a tap
 /s, /since *name* - the time since the last event with a given name was logged
-/t, /top *[N]* - top 10 or *N* events
-/tc, /topchart *[N]* - chart 10 or *N* events
+/share *name* *[member|viewer]* - share the event with someone else, they get a link to join. The members log it too, the viewers only look.
+/t, /top *[N]* *[range]* - top 10 or *N* events
+/tc, /topchart *[N]* *[range]* - chart 10 or *N* events
 /test - test if the bot works
+/wd, /weekdays *name* *[range]* - chart of the day of week the event is logged on
+/w, /who *name* - who logged the event last, handy in a shared group
+/y, /year *name* *[range]* - activity chart for the last year or *range*
+
+In any chat type @ and the bot name followed by the start of an event name to log it from there.
+
+A *range* is one of: 90d, 12w, 6m, 1y, 2024, 2024-05, 2026-01-01..2026-03-31 or all
 `)
 }
 
-func (c context) month(name string) {
+func (c context) hours(args string) error {
+	name, r, err := splitNameAndRange(args, c.now(), allTimeRange())
+	if err != nil {
+		return c.sendText(err.Error())
+	}
+
 	if name == "" {
-		c.sendMarkdown("Please provide a name: /month *name*")
-		return
+		return c.sendMarkdown("Please provide a name: /hours *name* *[range]*")
 	}
 
 	// DB
-	connection := c.db.Get(nil)
+	connection := getConnection(c.db)
 	defer c.db.Put(connection)
 
-	numDays := defaultMonthChartDays
-	now := int64(c.message.Date)
-	days := make([]int64, numDays)
+	counts := make([]int, hoursPerDay)
+	total := 0
+	err = forEachEventTime(connection, c.owner, name, r, c.config.Charts.location(), func(t time.Time) {
+		counts[t.Hour()]++
+		total++
+	})
 
-	done := errors.New("Done")
-	err := sqlitex.Exec(
-		connection,
-		"SELECT date FROM events "+
-			"WHERE user = ? AND name = ? "+
-			"ORDER BY date DESC",
-		func(s *sqlite.Stmt) error {
-			date := s.GetInt64("date")
+	if err != nil {
+		return err
+	}
 
-			daysAgo := int((now - date) / (24 * 60 * 60))
-			if daysAgo < 0 {
-				daysAgo = 0
-			}
+	if total == 0 {
+		return c.sendText(r.describe(fmt.Sprintf("You don't have any events named '%s'", name)))
+	}
 
-			if daysAgo >= numDays {
-				return done
-			}
+	labels := make([]string, hoursPerDay)
+	for i := range labels {
+		labels[i] = strconv.Itoa(i)
+	}
 
-			days[daysAgo]++
+	return c.sendChart(newHistogramChart(r.describe(fmt.Sprintf("Time of day for '%s'", name)), labels, counts))
+}
 
-			return nil
-		},
-		c.message.From.ID,
-		name)
+// Imports the attached document or the one the command is a reply to. The
+// arguments are the format and its options, like "csv date=2 name=1".
+func (c context) importFile(args string) error {
+	document := c.message.Document
+	if document == nil && c.message.ReplyToMessage != nil {
+		document = c.message.ReplyToMessage.Document
+	}
+
+	if document == nil {
+		return c.sendText("Please send a file produced by /export or reply to one with /import")
+	}
+
+	tooBig := fmt.Sprintf("The file is too big, the limit is %d MB", maxImportFileSize/1024/1024)
+	if document.FileSize > maxImportFileSize {
+		return c.sendText(tooBig)
+	}
+
+	// Guess the format of our own exports
+	format, options := splitFirstWord(args)
+	if format == "" {
+		format = "since"
+		if strings.HasSuffix(strings.ToLower(document.FileName), ".json") {
+			format = "json"
+		}
+	}
+
+	i, err := newImporter(format, options)
+	if err != nil {
+		return c.sendText(err.Error())
+	}
+
+	content, err := c.downloadFile(document.FileID, maxImportFileSize)
+	if err == errFileTooBig {
+		return c.sendText(tooBig)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// DB
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	result, err := importEvents(connection, c.owner, c.message.From.ID, i, bytes.NewReader(content))
+	if _, ok := err.(importError); ok {
+		return c.sendText(fmt.Sprintf("Failed to import '%s': %s", document.FileName, err))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.sendText(result.String())
+}
+
+func (c context) month(args string) error {
+	name, r, err := splitNameAndRange(args, c.now(), lastDaysRange(c.now(), c.config.Charts.MonthDays))
+	if err != nil {
+		return c.sendText(err.Error())
+	}
+
+	if name == "" {
+		return c.sendMarkdown("Please provide a name: /month *name* *[range]*")
+	}
+
+	numDays := r.numDays()
+	if numDays > c.config.Charts.MaxDays {
+		return c.sendText(fmt.Sprintf("Please pick a range no longer than %d days", c.config.Charts.MaxDays))
+	}
+
+	// DB
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
 
-	if err != nil && err != done {
-		log.Panic(err)
+	days, err := getDailyCounts(connection, c.owner, name, r)
+	if err != nil {
+		return err
 	}
 
-	maxValue := int64(-1)
+	maxValue := -1
 	for _, day := range days {
 		if day > maxValue {
 			maxValue = day
@@ -387,8 +769,7 @@ func (c context) month(name string) {
 	}
 
 	if maxValue <= 0 {
-		c.sendMarkdown(fmt.Sprintf("No events named '%s' have been logged in the last %d days", name, numDays))
-		return
+		return c.sendText(r.describe(fmt.Sprintf("No events named '%s' have been logged", name)))
 	}
 
 	values := make([]chart.Value, len(days))
@@ -404,18 +785,21 @@ func (c context) month(name string) {
 		}
 	}
 
+	// Make the bars thinner for the longer ranges
+	barWidth := clamp(1200/numDays, 2, 20)
+
 	// Chart settings
 	response := chart.BarChart{
-		Title:      fmt.Sprintf("Activity for '%s' in the last %d days", name, numDays),
+		Title:      r.describe(fmt.Sprintf("Activity for '%s'", name)),
 		TitleStyle: chart.StyleShow(),
 		Background: chart.Style{
 			Padding: chart.Box{
 				Top: 40,
 			},
 		},
-		Width:      numDays*22 + 80,
+		Width:      numDays*(barWidth+2) + 80,
 		Height:     256,
-		BarWidth:   20,
+		BarWidth:   barWidth,
 		BarSpacing: 2,
 		XAxis:      chart.StyleShow(),
 		YAxis: chart.YAxis{
@@ -426,58 +810,173 @@ func (c context) month(name string) {
 		Bars: values,
 	}
 
-	c.sendChart(response)
+	return c.sendChart(response)
 }
 
-func (c context) since(name string) {
+func (c context) punchCard(args string) error {
+	name, r, err := splitNameAndRange(args, c.now(), allTimeRange())
+	if err != nil {
+		return c.sendText(err.Error())
+	}
+
 	if name == "" {
-		c.sendMarkdown("Please provide a name: /since *name*")
-		return
+		return c.sendMarkdown("Please provide a name: /punchcard *name* *[range]*")
 	}
 
 	// DB
-	connection := c.db.Get(nil)
+	connection := getConnection(c.db)
 	defer c.db.Put(connection)
 
-	response := buildSinceResponse(name, int64(c.message.Date), int64(c.message.From.ID), connection)
-	if response == "" {
-		response = fmt.Sprintf("You don't have any events named '%s'", name)
-	}
-
-	c.sendText(response)
-}
-
-func (c context) test() {
-	c.sendText("It works")
-}
-
-func (c context) top(args string) {
-	num := parseTopArgs(args)
+	// One column per hour, one row per day of week
+	values := make([]int, hoursPerDay*daysPerWeek)
+	total := 0
+	err = forEachEventTime(connection, c.owner, name, r, c.config.Charts.location(), func(t time.Time) {
+		values[t.Hour()*daysPerWeek+weekdayIndex(t)]++
+		total++
+	})
 
-	response := strings.Builder{}
-	response.WriteString(fmt.Sprintf("These are your %d most logged events:\n```\n", num))
+	if err != nil {
+		return err
+	}
 
-	for _, e := range c.getTopEvents(num) {
-		response.WriteString(fmt.Sprintf("%s: %d\n", e.name, e.count))
+	if total == 0 {
+		return c.sendText(r.describe(fmt.Sprintf("You don't have any events named '%s'", name)))
 	}
 
-	response.WriteString("```\n")
+	// Label every third hour not to clutter the axis
+	labels := make([]string, hoursPerDay)
+	for i := 0; i < hoursPerDay; i += 3 {
+		labels[i] = strconv.Itoa(i)
+	}
 
-	c.sendMarkdown(response.String())
+	// Chart settings
+	response := ActivityChart{
+		Title:        r.describe(fmt.Sprintf("Punch card for '%s'", name)),
+		TitleStyle:   chart.StyleShow(),
+		Width:        800,
+		Height:       300,
+		XAxis:        chart.StyleShow(),
+		YAxis:        chart.StyleShow(),
+		Legend:       chart.StyleShow(),
+		Days:         values,
+		ColumnLabels: labels,
+	}
+
+	return c.sendChart(response)
 }
 
-func (c context) topChart(args string) {
-	num := parseTopArgs(args)
+func (c context) quick(args string) error {
+	num := defaultQuickCount
+	if n, err := strconv.Atoi(strings.TrimSpace(args)); err == nil {
+		num = clamp(n, 1, maxQuickCount)
+	}
+
+	events, err := c.getTopEvents(num, allTimeRange())
+	if err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		return c.sendText("Nothing to show yet. Send an event name to log it first.")
+	}
+
+	buttons := []tgbotapi.InlineKeyboardButton{}
+	for _, e := range events {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(e.name, addCallbackData(e.lastID)))
+	}
+
+	return c.sendInlineKeyboard("Tap to log:", buttons)
+}
+
+func (c context) since(name string) error {
+	if name == "" {
+		return c.sendMarkdown("Please provide a name: /since *name*")
+	}
+
+	// DB
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	response, err := buildSinceResponse(name, int64(c.message.Date), int64(c.owner), connection)
+	if err != nil {
+		return err
+	}
+
+	if response != "" {
+		return c.sendText(response)
+	}
+
+	similar, err := findSimilarNames(connection, c.owner, name, 2, true)
+	if err != nil {
+		return err
+	}
+
+	if len(similar) > 0 {
+		return c.suggestNames(
+			fmt.Sprintf("You don't have any events named '%s'. Did you mean one of these?", name),
+			similar,
+			sinceCallbackData)
+	}
+
+	return c.sendText(fmt.Sprintf("You don't have any events named '%s'", name))
+}
+
+func (c context) test() error {
+	return c.sendText("It works")
+}
+
+func (c context) top(args string) error {
+	num, r, err := parseTopArgs(args, c.now(), c.config.Charts)
+	if err != nil {
+		return c.sendText(err.Error())
+	}
+
+	events, err := c.getTopEvents(num, r)
+	if err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		return c.sendText(r.describe("You don't have any events"))
+	}
+
+	response := strings.Builder{}
+	response.WriteString(r.describe(fmt.Sprintf("These are your %d most logged events", num)))
+	response.WriteString(":\n```\n")
+
+	for _, e := range events {
+		response.WriteString(fmt.Sprintf("%s: %d\n", e.name, e.count))
+	}
+
+	response.WriteString("```\n")
+
+	return c.sendMarkdown(response.String())
+}
+
+func (c context) topChart(args string) error {
+	num, r, err := parseTopArgs(args, c.now(), c.config.Charts)
+	if err != nil {
+		return c.sendText(err.Error())
+	}
+
+	events, err := c.getTopEvents(num, r)
+	if err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		return c.sendText(r.describe("You don't have any events"))
+	}
 
 	// Convert values
 	values := make([]chart.Value, 0, num)
-	for _, e := range c.getTopEvents(num) {
+	for _, e := range events {
 		values = append(values, chart.Value{Label: e.name, Value: float64(e.count)})
 	}
 
 	// Chart settings
 	response := chart.BarChart{
-		Title:      fmt.Sprintf("Top %d events", num),
+		Title:      r.describe(fmt.Sprintf("Top %d events", num)),
 		TitleStyle: chart.StyleShow(),
 		Background: chart.Style{
 			Padding: chart.Box{
@@ -496,68 +995,83 @@ func (c context) topChart(args string) {
 		Bars: values,
 	}
 
-	c.sendChart(response)
+	return c.sendChart(response)
 }
 
-func (c context) year(name string) {
+func (c context) weekdays(args string) error {
+	name, r, err := splitNameAndRange(args, c.now(), allTimeRange())
+	if err != nil {
+		return c.sendText(err.Error())
+	}
+
 	if name == "" {
-		c.sendMarkdown("Please provide a name: /year *name*")
-		return
+		return c.sendMarkdown("Please provide a name: /weekdays *name* *[range]*")
 	}
 
 	// DB
-	connection := c.db.Get(nil)
+	connection := getConnection(c.db)
 	defer c.db.Put(connection)
 
-	numWeeks := defaultYearChartWeeks
-	numDays := numWeeks * 7
-	now := int64(c.message.Date)
-	days := make([]int, numDays)
+	counts := make([]int, daysPerWeek)
+	total := 0
+	err = forEachEventTime(connection, c.owner, name, r, c.config.Charts.location(), func(t time.Time) {
+		counts[weekdayIndex(t)]++
+		total++
+	})
 
-	done := errors.New("Done")
-	err := sqlitex.Exec(
-		connection,
-		"SELECT date FROM events "+
-			"WHERE user = ? AND name = ? "+
-			"ORDER BY date DESC",
-		func(s *sqlite.Stmt) error {
-			date := s.GetInt64("date")
+	if err != nil {
+		return err
+	}
 
-			daysAgo := int((now - date) / (24 * 60 * 60))
-			if daysAgo < 0 {
-				daysAgo = 0
-			}
+	if total == 0 {
+		return c.sendText(r.describe(fmt.Sprintf("You don't have any events named '%s'", name)))
+	}
 
-			if daysAgo >= numDays {
-				return done
-			}
+	return c.sendChart(newHistogramChart(r.describe(fmt.Sprintf("Day of week for '%s'", name)), weekdayLabels, counts))
+}
 
-			days[daysAgo]++
+func (c context) year(args string) error {
+	name, r, err := splitNameAndRange(args, c.now(), lastDaysRange(c.now(), c.config.Charts.YearWeeks*daysPerWeek))
+	if err != nil {
+		return c.sendText(err.Error())
+	}
 
-			return nil
-		},
-		c.message.From.ID,
-		name)
+	if name == "" {
+		return c.sendMarkdown("Please provide a name: /year *name* *[range]*")
+	}
 
-	if err != nil && err != done {
-		log.Panic(err)
+	numDays := r.numDays()
+	if numDays > c.config.Charts.MaxDays {
+		return c.sendText(fmt.Sprintf("Please pick a range no longer than %d days", c.config.Charts.MaxDays))
 	}
 
-	today := time.Unix(now, 0)
+	// DB
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	days, err := getDailyCounts(connection, c.owner, name, r)
+	if err != nil {
+		return err
+	}
+
+	// The chart is drawn backwards from the last day of the range
+	lastDay := r.dayStart(0)
 
 	// Chart settings
 	response := ActivityChart{
+		Title:        r.describe(fmt.Sprintf("Activity for '%s'", name)),
+		TitleStyle:   chart.StyleShow(),
 		Width:        1200,
 		XAxis:        chart.StyleShow(),
 		YAxis:        chart.StyleShow(),
 		Legend:       chart.StyleShow(),
 		Days:         days,
-		CurrentDay:   (int(today.Weekday()) - 1 + 7) % 7, // Weekday return 0 for Sunday
-		CurrentMonth: int(today.Month()) - 1,             // Month is 1 based
+		CurrentDay:   weekdayIndex(lastDay),
+		CurrentMonth: int(lastDay.Month()) - 1, // Month is 1 based
 		RightToLeft:  true,
 	}
 
-	c.sendChart(response)
+	return c.sendChart(response)
 }
 
 //
@@ -576,162 +1090,848 @@ func clamp(value, min, max int) int {
 	return value
 }
 
-func parseTopArgs(args string) int {
-	num, err := strconv.Atoi(args)
-	if err != nil {
-		return defaultTopCount
+// Parses "[N] [range]". A number that comes first is always N, so "/top 2024"
+// is the top 2024 (as many as allowed) and "/top 10 2024" is the top 10 in 2024.
+func parseTopArgs(args string, now time.Time, charts ChartsConfig) (int, timeRange, error) {
+	num := charts.TopCount
+	r := allTimeRange()
+
+	for i, arg := range strings.Fields(args) {
+		n, err := strconv.Atoi(arg)
+		if i == 0 && err == nil {
+			num = clamp(n, minTopCount, charts.MaxTopCount)
+			continue
+		}
+
+		parsed, ok, err := parseTimeRange(arg, now)
+		if err != nil {
+			return 0, r, err
+		}
+
+		if ok {
+			r = parsed
+		} else if n, err := strconv.Atoi(arg); err == nil {
+			num = clamp(n, minTopCount, charts.MaxTopCount)
+		}
+	}
+
+	return num, r, nil
+}
+
+// Splits "word the rest" into "word" and "the rest"
+func splitFirstWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
 	}
 
-	return clamp(num, minTopCount, maxTopCount)
+	return s, ""
+}
+
+// Weekday returns 0 for Sunday, we want the week to start on Monday
+func weekdayIndex(t time.Time) int {
+	return (int(t.Weekday()) + 6) % 7
+}
+
+// Returns the number of events with the given name per calendar day within the
+// range. The index is the number of days before the last day of the range.
+func getDailyCounts(connection *sqlite.Conn, userID int, name string, r timeRange) ([]int, error) {
+	days := make([]int, r.numDays())
+
+	err := forEachEventTime(connection, userID, name, r, r.zone(), func(t time.Time) {
+		days[r.dayIndex(t.Unix())]++
+	})
+
+	return days, err
+}
+
+// Calls f with the time of every event with the given name within the range.
+// The time is in the location, the hours and the weekdays depend on it.
+func forEachEventTime(connection *sqlite.Conn, userID int, name string, r timeRange, location *time.Location, f func(t time.Time)) error {
+	return sqlitex.Exec(
+		connection,
+		"SELECT date FROM events "+
+			"WHERE "+visibleEvents+" AND name_hash = name_hash(?) AND date >= ? AND date < ?",
+		func(s *sqlite.Stmt) error {
+			f(time.Unix(s.GetInt64("date"), 0).In(location))
+			return nil
+		},
+		userID,
+		name,
+		r.from,
+		r.to)
+}
+
+func newHistogramChart(title string, labels []string, counts []int) chart.BarChart {
+	maxValue := 0
+	values := make([]chart.Value, len(counts))
+	for i, count := range counts {
+		if count > maxValue {
+			maxValue = count
+		}
+
+		values[i] = chart.Value{
+			Label: labels[i],
+			Value: float64(count),
+			Style: chart.Style{
+				Show:        true,
+				StrokeWidth: 1,
+				StrokeColor: chart.ColorAlternateGreen,
+				FillColor:   chart.ColorAlternateGreen,
+			},
+		}
+	}
+
+	return chart.BarChart{
+		Title:      title,
+		TitleStyle: chart.StyleShow(),
+		Background: chart.Style{
+			Padding: chart.Box{
+				Top: 40,
+			},
+		},
+		Width:      len(counts)*42 + 80,
+		Height:     256,
+		BarWidth:   40,
+		BarSpacing: 2,
+		XAxis:      chart.StyleShow(),
+		YAxis: chart.YAxis{
+			Style:          chart.StyleShow(),
+			ValueFormatter: chart.IntValueFormatter,
+			Range:          &chart.ContinuousRange{Min: 0, Max: float64(maxValue)},
+		},
+		Bars: values,
+	}
 }
 
 type topEvent struct {
-	name  string
-	count int64
+	name   string
+	count  int64
+	lastID int64 // To refer to the event where the name doesn't fit
 }
 
-func (c context) getTopEvents(num int) []topEvent {
+func (c context) getTopEvents(num int, r timeRange) ([]topEvent, error) {
 	// DB
-	connection := c.db.Get(nil)
+	connection := getConnection(c.db)
 	defer c.db.Put(connection)
 
 	events := make([]topEvent, 0, num)
 	err := sqlitex.ExecTransient(
 		connection,
 		fmt.Sprintf(
-			"SELECT name, COUNT(name) freq FROM events "+
-				"WHERE user = ? "+
-				"GROUP BY name "+
+			"SELECT decrypt_name(name) name, COUNT(*) freq, MAX(id) last_id FROM events "+
+				"WHERE "+visibleEvents+" AND date >= ? AND date < ? "+
+				"GROUP BY name_hash "+
 				"ORDER BY freq DESC "+
 				"LIMIT %d",
 			num),
 		func(s *sqlite.Stmt) error {
-			events = append(events, topEvent{name: s.GetText("name"), count: s.GetInt64("freq")})
+			events = append(events, topEvent{
+				name:   s.GetText("name"),
+				count:  s.GetInt64("freq"),
+				lastID: s.GetInt64("last_id"),
+			})
 			return nil
 		},
-		c.message.From.ID)
+		c.owner,
+		r.from,
+		r.to)
+
+	return events, err
+}
 
+func reply(update tgbotapi.Update, db *sqlitex.Pool, bot *tgbotapi.BotAPI, sender *sender, jobs *scheduler, config Config) {
+	// Store all the variables into the context not to pass around all the arguments everywhere
+	c := newContext(update, db, bot, sender, jobs, config)
+	message := c.message
+
+	if message.From != nil {
+		seenUsers.seen(message.From.ID, time.Now())
+	}
+
+	// Telegram might send it again if the bot went down before saving the offset
+	processed, err := c.isProcessed()
 	if err != nil {
-		log.Panic(err)
+		c.logger().Error("Failed to check if the update is processed", "error", err)
+	}
+
+	if processed {
+		c.logger().Info("Update is processed already, skipping")
+		return
 	}
 
-	return events
+	// Even when it failed. The user got an apology, and trying again is not
+	// likely to help.
+	defer c.markProcessed()
+
+	started := time.Now()
+	defer func() {
+		observeCommand(c.command(), started)
+		c.logger().Info("Update handled", "duration", time.Since(started))
+	}()
+
+	// One bad message should never take the whole bot down
+	defer func() {
+		if r := recover(); r != nil {
+			c.handlePanic(r, debug.Stack())
+		}
+	}()
+
+	if err := c.dispatch(); err != nil {
+		c.handleError(err)
+	}
 }
 
-func reply(message *tgbotapi.Message, db *sqlitex.Pool, bot *tgbotapi.BotAPI) {
-	// Store all the variables into the context not to pass around all the arguments everywhere
-	c := context{message: message, db: db, bot: bot}
+func (c context) isProcessed() (bool, error) {
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	return isUpdateProcessed(connection, c.updateID)
+}
 
-	// TODO: Should we always recover, not only in debug?
-	if debugSendPanicToChat {
-		defer func() {
-			if r := recover(); r != nil {
-				// When we recover from panic, the runtime doesn't print the callstack
-				debug.PrintStack()
+func (c context) markProcessed() {
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
 
-				// Send to the curious user as well
-				c.sendMarkdown(fmt.Sprintf("*Internal error:*\n```\n%s\n```\n", r))
-			}
-		}()
+	if _, err := markUpdateProcessed(connection, c.updateID, c.now().Unix()); err != nil {
+		c.logger().Error("Failed to mark the update processed", "error", err)
+	}
+}
+
+func (c context) dispatch() error {
+	message := c.message
+
+	// Not even a refusal for the messages meant for someone else
+	if c.callback == nil && c.inlineQuery == nil && c.chosenResult == nil && !c.addressedToBot() {
+		return nil
+	}
+
+	allowed, err := c.checkAccess()
+	if !allowed || err != nil {
+		return err
+	}
+
+	c.owner, err = c.eventOwner()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c.callback != nil:
+		return c.handleCallback()
+	case c.inlineQuery != nil:
+		return c.answerInline()
+	case c.chosenResult != nil:
+		return c.logChosenInline()
 	}
 
 	if message.IsCommand() {
 		switch command := message.Command(); command {
 		case "a", "add":
-			c.add(message.CommandArguments())
+			return c.add(message.CommandArguments())
+		case "admin":
+			if c.isAdmin() {
+				return c.admin(message.CommandArguments())
+			}
+			return c.sendText(fmt.Sprintf("Eh? /%s?", command))
+		case "c", "compare":
+			return c.compare(message.CommandArguments())
+		case "deleteme":
+			return c.deleteMe()
 		case "e", "export":
-			c.export()
+			return c.export(message.CommandArguments())
+		case "forget":
+			return c.forget(message.CommandArguments())
+		case "group":
+			return c.group(message.CommandArguments())
 		case "h", "help":
-			c.help()
+			return c.help()
+		case "hi", "history":
+			return c.history(message.CommandArguments())
+		case "hr", "hours":
+			return c.hours(message.CommandArguments())
+		case "i", "import":
+			return c.importFile(message.CommandArguments())
+		case "l", "list":
+			return c.list(message.CommandArguments())
 		case "m", "month":
-			c.month(message.CommandArguments())
+			return c.month(message.CommandArguments())
+		case "pc", "punchcard":
+			return c.punchCard(message.CommandArguments())
+		case "q", "quick":
+			return c.quick(message.CommandArguments())
 		case "s", "since":
-			c.since(message.CommandArguments())
+			return c.since(message.CommandArguments())
+		case "share":
+			return c.share(message.CommandArguments())
+		case "start":
+			// The tracker invites come through the links as well
+			if args := message.CommandArguments(); strings.HasPrefix(args, shareCodePrefix) {
+				return c.joinTracker(args)
+			}
+
+			// The first thing the users send, and the access invite code is checked already
+			return c.help()
 		case "test":
-			c.test()
+			return c.test()
 		case "t", "top":
-			c.top(message.CommandArguments())
+			return c.top(message.CommandArguments())
 		case "tc", "topchart":
-			c.topChart(message.CommandArguments())
+			return c.topChart(message.CommandArguments())
+		case "wd", "weekdays":
+			return c.weekdays(message.CommandArguments())
+		case "w", "who":
+			return c.who(message.CommandArguments())
 		case "y", "year":
-			c.year(message.CommandArguments())
+			return c.year(message.CommandArguments())
 		default:
-			c.sendText(fmt.Sprintf("Eh? /%s?", command))
+			return c.sendText(fmt.Sprintf("Eh? /%s?", command))
 		}
-	} else {
-		c.add(message.Text)
 	}
+
+	if message.Document != nil {
+		// Not every file sent to the bot is meant to be imported. The caption
+		// is the format, like "loop" or "since" for our own export.
+		if strings.TrimSpace(message.Caption) == "" {
+			return c.sendText("To import this file, reply to it with /import or send it again with the format as the caption, like 'since' for the /export files")
+		}
+
+		return c.importFile(message.Caption)
+	}
+
+	return c.add(message.Text)
+}
+
+// All the tables, created at the start when missing
+var schema = []string{
+	// The user is the owner, the author is who logged it. They only differ in
+	// the shared groups, where the chat is the owner. The events in a shared
+	// tracker have the tracker and no user.
+	"CREATE TABLE IF NOT EXISTS events (" +
+		"id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, " +
+		"user INTEGER, " +
+		"name TEXT, " +
+		"date INTEGER, " +
+		"author INTEGER, " +
+		"tracker INTEGER, " +
+		"name_hash TEXT);",
+
+	// Bot state that should survive a restart, like the update offset
+	"CREATE TABLE IF NOT EXISTS state (" +
+		"key TEXT NOT NULL PRIMARY KEY, " +
+		"value INTEGER);",
+
+	// IDs of the updates that are handled but not yet covered by the saved offset
+	"CREATE TABLE IF NOT EXISTS updates (" +
+		"id INTEGER NOT NULL PRIMARY KEY, " +
+		"date INTEGER);",
+
+	// Users the bot ignores completely
+	"CREATE TABLE IF NOT EXISTS blocked (" +
+		"user INTEGER NOT NULL PRIMARY KEY, " +
+		"date INTEGER);",
+
+	// Users let in by an admin or with an invite code
+	"CREATE TABLE IF NOT EXISTS allowed (" +
+		"user INTEGER NOT NULL PRIMARY KEY, " +
+		"code TEXT, " +
+		"date INTEGER);",
+
+	// Single use invite codes, the user is set once it's used
+	"CREATE TABLE IF NOT EXISTS invites (" +
+		"code TEXT NOT NULL PRIMARY KEY, " +
+		"admin INTEGER, " +
+		"date INTEGER, " +
+		"user INTEGER);",
+
+	// Everything the admins did
+	"CREATE TABLE IF NOT EXISTS audit (" +
+		"id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, " +
+		"admin INTEGER, " +
+		"action TEXT, " +
+		"args TEXT, " +
+		"date INTEGER);",
+
+	// Group chats where the events belong to the chat and not to the members
+	"CREATE TABLE IF NOT EXISTS shared_chats (" +
+		"chat INTEGER NOT NULL PRIMARY KEY, " +
+		"user INTEGER, " +
+		"date INTEGER);",
+
+	// Events shared by a few users, see trackers.go
+	"CREATE TABLE IF NOT EXISTS trackers (" +
+		"id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, " +
+		"name TEXT, " +
+		"date INTEGER, " +
+		"name_hash TEXT);",
+
+	"CREATE TABLE IF NOT EXISTS tracker_members (" +
+		"tracker INTEGER NOT NULL, " +
+		"user INTEGER NOT NULL, " +
+		"role TEXT, " +
+		"date INTEGER, " +
+		"PRIMARY KEY (tracker, user));",
+
+	// Single use like the access invites, the user is set once it's used
+	"CREATE TABLE IF NOT EXISTS tracker_invites (" +
+		"code TEXT NOT NULL PRIMARY KEY, " +
+		"tracker INTEGER, " +
+		"role TEXT, " +
+		"owner INTEGER, " +
+		"date INTEGER, " +
+		"user INTEGER);",
 }
 
-func openDB() *sqlitex.Pool {
-	db, err := sqlitex.Open("./since.db", 0, 16)
+// Columns added after the table was created. The older databases get them at
+// the start.
+var addedColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"events", "author", "INTEGER"},
+	{"events", "tracker", "INTEGER"},
+	{"events", "name_hash", "TEXT"},
+	{"trackers", "name_hash", "TEXT"},
+}
+
+// On the added columns, so they go after them
+var indexes = []string{
+	// Every lookup by the name goes through the hash
+	"CREATE INDEX IF NOT EXISTS events_name_hash ON events (name_hash);",
+}
+
+func openDB(config DatabaseConfig) (*sqlitex.Pool, error) {
+	if err := setupEncryption(config); err != nil {
+		return nil, fmt.Errorf("Invalid encryption key: %s", err)
+	}
+
+	db, err := sqlitex.Open(config.Path, 0, config.PoolSize)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
+
+	if err = initConnections(db, config.PoolSize); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, sql := range schema {
+		if err = execSQL(db, sql); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if err = addMissingColumns(db); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	execSQL(db,
-		"CREATE TABLE IF NOT EXISTS events ("+
-			"id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, "+
-			"user INTEGER, "+
-			"name TEXT, "+
-			"date INTEGER);")
+	for _, sql := range indexes {
+		if err = execSQL(db, sql); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
 
-	return db
+	if err = migrateNames(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func addMissingColumns(db *sqlitex.Pool) error {
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	for _, c := range addedColumns {
+		exists := false
+		err := sqlitex.Exec(
+			connection,
+			fmt.Sprintf(`PRAGMA table_info("%s");`, c.table),
+			func(s *sqlite.Stmt) error {
+				if s.GetText("name") == c.column {
+					exists = true
+				}
+				return nil
+			})
+
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			err = sqlitex.ExecTransient(
+				connection,
+				fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN "%s" %s;`, c.table, c.column, c.definition),
+				nil)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func execSQL(db *sqlitex.Pool, sql string) error {
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	return sqlitex.Exec(connection, sql, nil)
 }
 
-func execSQL(db *sqlitex.Pool, sql string) {
-	connection := db.Get(nil)
+// Imports a file straight into the database:
+// since-bot import -user ID [-format since] [-options "key=value ..."] file
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	userID := flags.Int("user", 0, "Telegram user ID to import the events for")
+	format := flags.String("format", "since", "File format: "+importFormats())
+	options := flags.String("options", "", "Format options, like \"date=timestamp name=activity\"")
+
+	config, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+
+	setupLogging(config.Log)
+
+	if *userID == 0 || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	i, err := newImporter(*format, *options)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	db, err := openDB(config.Database)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	connection := getConnection(db)
 	defer db.Put(connection)
 
-	err := sqlitex.Exec(connection, sql, nil)
+	result, err := importEvents(connection, *userID, *userID, i, file)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+
+	fmt.Println(result)
+
+	return nil
 }
 
-func main() {
-	config := readConfig()
+func run(args []string) error {
+	config, err := loadConfig(flag.NewFlagSet("since-bot", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+
+	setupLogging(config.Log)
+
+	if config.Token == "" {
+		return fmt.Errorf("The bot token is not set. Put it into the config, %sTOKEN or -token.", envPrefix)
+	}
+
+	db, err := openDB(config.Database)
+	if err != nil {
+		return err
+	}
 
-	db := openDB()
 	defer db.Close()
 
 	if debugChartEnabled {
 		c := context{
-			db: db,
+			db:     db,
+			config: config,
+			owner:  37121672,
 			message: &tgbotapi.Message{
 				Date: int(time.Now().Unix()),
 				From: &tgbotapi.User{ID: 37121672},
 			},
 		}
-		c.year("commit")
-		//c.topChart("")
-		return
+		return c.year("commit")
+		//return c.topChart("")
 	}
 
 	bot, err := tgbotapi.NewBotAPI(config.Token)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	bot.Debug = false
-	log.Printf("Authorized on account %s", bot.Self.UserName)
+	slog.Info("Authorized", "account", bot.Self.UserName)
 
-	updateConfig := tgbotapi.NewUpdate(0)
-	updateConfig.Timeout = 60
+	// Continue where the previous run stopped
+	offset, err := loadUpdateOffset(db)
+	if err != nil {
+		return err
+	}
 
-	updates, err := bot.GetUpdatesChan(updateConfig)
+	slog.Info("Starting", "offset", offset)
+
+	updates, stopReceiving, err := receiveUpdates(bot, config.Telegram, offset)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	for update := range updates {
-		// Ignore any non-Message Updates
-		if update.Message == nil {
-			continue
+	// The background jobs, the long admin commands run here as well
+	jobs := newScheduler()
+
+	sender := newSender(bot)
+	workers := newDispatcher(config.Workers, defaultWorkerQueueSize, func(update tgbotapi.Update) {
+		reply(update, db, bot, sender, jobs, config)
+	})
+
+	limiter := newRateLimiter(config.RateLimit)
+	workers.setRateLimit(limiter, func(update tgbotapi.Update) {
+		// Not to hold up the polling
+		go func() {
+			c := newContext(update, db, bot, sender, jobs, config)
+			if err := c.sendText(slowDownMessage); err != nil {
+				c.logger().Error("Failed to send the slow down notice", "error", err)
+			}
+		}()
+	})
+
+	// Don't lose the progress if the process is killed without a warning
+	jobs.every(offsetSaveInterval, "save the update offset", func() error {
+		return saveUpdateOffset(db, workers.safeOffset())
+	})
+	jobs.every(idleBucketTimeout, "prune the rate limits", func() error {
+		now := time.Now()
+		limiter.prune(now)
+		sender.prune(now)
+		return nil
+	})
+
+	jobs.every(activeUsersInterval, "count the active users", func() error {
+		seenUsers.update(time.Now())
+		return nil
+	})
+
+	jobs.every(compactInterval, "compact the database", func() error {
+		return compactDB(db)
+	})
+
+	if config.Backup.Dir != "" {
+		jobs.every(backupCheckInterval, "back up the database", func() error {
+			return scheduledBackup(db, config.Backup.Dir, time.Now())
+		})
+	}
+
+	if config.Metrics.Listen != "" {
+		metrics := serveMetrics(config, db)
+		defer metrics.Close()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	handleUpdate := func(update tgbotapi.Update) {
+		// Only the messages, the button presses and the inline mode for now
+		if update.Message == nil &&
+			update.CallbackQuery == nil &&
+			update.InlineQuery == nil &&
+			update.ChosenInlineResult == nil {
+			return
+		}
+
+		slog.Debug(
+			"Update received",
+			"update_id", update.UpdateID,
+			"user_id", updateUserID(update),
+			"command", updateCommand(update),
+			"text", redact(updateText(update)))
+
+		workers.dispatch(update)
+	}
+
+loop:
+	for {
+		select {
+		case update := <-updates:
+			handleUpdate(update)
+		case s := <-signals:
+			slog.Info("Shutting down", "signal", s.String())
+			break loop
+		}
+	}
+
+	stopReceiving()
+	sender.stop()
+
+	// The webhook has already told Telegram these are received, they are not
+	// coming again. The polling doesn't leave anything here, the updates it
+	// didn't hand over are not confirmed and come again after the restart.
+drain:
+	for {
+		select {
+		case update := <-updates:
+			handleUpdate(update)
+		default:
+			break drain
 		}
+	}
+
+	if !waitWithTimeout(defaultShutdownTimeout, workers.stop, jobs.stop) {
+		// The workers that are still running use the pool, so it can't be closed,
+		// and the offset can't cover their updates either. The last offset saved
+		// by the job is behind them, those updates come again after the restart.
+		slog.Error("Timed out waiting for the updates in flight, exiting without saving the offset", "timeout", defaultShutdownTimeout)
+		os.Exit(1)
+	}
+
+	return saveUpdateOffset(db, workers.safeOffset())
+}
+
+// Starts receiving the updates with long polling or with the webhook. The
+// returned function stops it.
+func receiveUpdates(bot *tgbotapi.BotAPI, config TelegramConfig, offset int) (tgbotapi.UpdatesChannel, func(), error) {
+	if config.Mode == webhookMode {
+		return receiveWebhookUpdates(bot, config)
+	}
+
+	// getUpdates doesn't work while there's a webhook left from before
+	if _, err := bot.RemoveWebhook(); err != nil {
+		return nil, nil, err
+	}
 
-		log.Printf("[%s] %s", update.Message.From.UserName, update.Message.Text)
+	updateConfig := tgbotapi.NewUpdate(offset)
+	updateConfig.Timeout = config.PollTimeout
 
-		go reply(update.Message, db, bot)
+	updates, stop := pollUpdates(bot, updateConfig)
+	return updates, stop, nil
+}
+
+// Same as GetUpdatesChan, but it also keeps track of the successful polls for
+// the health check. The next poll confirms to Telegram everything below the
+// offset, so the offset only moves past the updates that have been taken from
+// the unbuffered channel. The ones that are not taken by the time it's stopped
+// are sent again after the restart.
+func pollUpdates(bot *tgbotapi.BotAPI, config tgbotapi.UpdateConfig) (tgbotapi.UpdatesChannel, func()) {
+	updates := make(chan tgbotapi.Update)
+	quit := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+
+			// There's no way to cancel the request in flight, it returns within
+			// the poll timeout and the result is dropped below
+			received, err := bot.GetUpdates(config)
+			if err != nil {
+				slog.Warn("Failed to get updates, retrying", "retry_in", pollRetryInterval, "error", err)
+				select {
+				case <-quit:
+					return
+				case <-time.After(pollRetryInterval):
+				}
+				continue
+			}
+
+			recordPoll(time.Now())
+
+			for _, update := range received {
+				if update.UpdateID < config.Offset {
+					continue
+				}
+
+				select {
+				case updates <- update:
+					config.Offset = update.UpdateID + 1
+				case <-quit:
+					return
+				}
+			}
+		}
+	}()
+
+	return updates, func() { close(quit) }
+}
+
+// With the webhook Telegram keeps the offset. The updates that didn't get
+// a response in time are delivered again.
+func receiveWebhookUpdates(bot *tgbotapi.BotAPI, config TelegramConfig) (tgbotapi.UpdatesChannel, func(), error) {
+	webhookURL, err := url.Parse(config.WebhookURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	webhook := tgbotapi.NewWebhook(config.WebhookURL)
+	if config.WebhookCert != "" {
+		webhook = tgbotapi.NewWebhookWithCert(config.WebhookURL, config.WebhookCert)
+	}
+
+	if _, err := bot.SetWebhook(webhook); err != nil {
+		return nil, nil, err
+	}
+
+	path := webhookURL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	updates := bot.ListenForWebhook(path)
+	server := &http.Server{Addr: config.WebhookListen}
+
+	go func() {
+		var err error
+		if config.WebhookCert != "" {
+			err = server.ListenAndServeTLS(config.WebhookCert, config.WebhookKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("Webhook server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	slog.Info("Listening for the webhook", "address", config.WebhookListen, "path", path)
+
+	stop := func() {
+		if err := server.Close(); err != nil {
+			slog.Error("Failed to stop the webhook server", "error", err)
+		}
+	}
+
+	return updates, stop, nil
+}
+
+func main() {
+	var err error
+
+	// Subcommands that work with the database directly
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		err = importCommand(os.Args[2:])
+	} else {
+		err = run(os.Args[1:])
+	}
+
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	activeUsersWindow   = 24 * time.Hour
+	activeUsersInterval = time.Minute
+
+	healthCheckTimeout = 5 * time.Second
+)
+
+// The metrics are always collected, they are cheap. They are only exposed
+// when the metrics listener is configured.
+var (
+	updatesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "since_updates_total",
+		Help: "Number of the handled updates by command.",
+	}, []string{"command"})
+
+	commandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "since_command_duration_seconds",
+		Help:    "Time it takes to handle a command.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"command"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "since_sqlite_query_duration_seconds",
+		Help:    "Time spent in SQLite by statement type.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"statement"})
+
+	poolWaitDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "since_db_pool_wait_seconds",
+		Help:    "Time spent waiting for a free database connection.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+
+	chartRenderDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "since_chart_render_seconds",
+		Help:    "Time it takes to render a chart.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	chartBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "since_chart_bytes",
+		Help:    "Size of the rendered chart images.",
+		Buckets: prometheus.ExponentialBuckets(4096, 2, 10),
+	})
+
+	sendErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "since_send_errors_total",
+		Help: "Failed sends to Telegram by error type.",
+	}, []string{"type"})
+
+	activeUsersGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "since_active_users",
+		Help: "Users seen in the last 24 hours.",
+	})
+)
+
+// Command aliases to the names used in the metrics. Anything not here is
+// "unknown", the command names come from the users and can't be trusted to
+// keep the number of labels small.
+var metricCommands = map[string]string{
+	"a":         "add",
+	"add":       "add",
+	"admin":     "admin",
+	"c":         "compare",
+	"compare":   "compare",
+	"deleteme":  "deleteme",
+	"e":         "export",
+	"export":    "export",
+	"forget":    "forget",
+	"group":     "group",
+	"h":         "help",
+	"help":      "help",
+	"hi":        "history",
+	"history":   "history",
+	"hr":        "hours",
+	"hours":     "hours",
+	"i":         "import",
+	"import":    "import",
+	"l":         "list",
+	"list":      "list",
+	"m":         "month",
+	"month":     "month",
+	"pc":        "punchcard",
+	"punchcard": "punchcard",
+	"q":         "quick",
+	"quick":     "quick",
+	"s":         "since",
+	"since":     "since",
+	"share":     "share",
+	"start":     "start",
+	"test":      "test",
+	"t":         "top",
+	"top":       "top",
+	"tc":        "topchart",
+	"topchart":  "topchart",
+	"wd":        "weekdays",
+	"weekdays":  "weekdays",
+	"w":         "who",
+	"who":       "who",
+	"y":         "year",
+	"year":      "year",
+}
+
+// The command name as it goes into the metrics
+func metricCommand(message *tgbotapi.Message) string {
+	if message == nil {
+		return "none"
+	}
+
+	if message.IsCommand() {
+		if name, ok := metricCommands[strings.ToLower(message.Command())]; ok {
+			return name
+		}
+		return "unknown"
+	}
+
+	if message.Document != nil {
+		return "import"
+	}
+
+	return "add"
+}
+
+// Same for the whole update, the button presses are all "callback" and so on
+func updateCommand(update tgbotapi.Update) string {
+	switch {
+	case update.CallbackQuery != nil:
+		return "callback"
+	case update.InlineQuery != nil:
+		return "inline"
+	case update.ChosenInlineResult != nil:
+		return "inline_chosen"
+	}
+
+	return metricCommand(update.Message)
+}
+
+func observeCommand(command string, started time.Time) {
+	updatesTotal.WithLabelValues(command).Inc()
+	commandDuration.WithLabelValues(command).Observe(time.Since(started).Seconds())
+}
+
+func observeSendError(err error) {
+	errorType := "network"
+	if _, ok := err.(tgbotapi.Error); ok {
+		errorType = "api"
+	}
+
+	if retryAfter(err) > 0 {
+		errorType = "too_many_requests"
+	}
+
+	sendErrors.WithLabelValues(errorType).Inc()
+}
+
+//
+// Database
+//
+
+// queryTracer times the statements. SQLite calls it for every Step.
+type queryTracer struct{}
+
+func (queryTracer) NewTask(query string) sqlite.TracerTask {
+	return &queryTask{statement: statementType(query)}
+}
+
+func (queryTracer) Push(name string) {}
+func (queryTracer) Pop()             {}
+
+// queryTask only counts the time inside SQLite, not the time the rows spend
+// in the callbacks
+type queryTask struct {
+	statement string
+	started   time.Time
+	total     time.Duration
+}
+
+func (t *queryTask) StartRegion(regionType string) {
+	t.started = time.Now()
+}
+
+func (t *queryTask) EndRegion() {
+	t.total += time.Since(t.started)
+}
+
+func (t *queryTask) End() {
+	queryDuration.WithLabelValues(t.statement).Observe(t.total.Seconds())
+}
+
+// "SELECT ..." -> "select"
+func statementType(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "other"
+	}
+
+	switch statement := strings.ToLower(fields[0]); statement {
+	case "select", "insert", "update", "delete", "pragma", "create", "vacuum":
+		return statement
+	}
+
+	return "other"
+}
+
+//
+// Active users
+//
+
+// activeUsers remembers when every user was seen last
+type activeUsers struct {
+	mutex sync.Mutex
+	users map[int]time.Time
+}
+
+var seenUsers = &activeUsers{users: map[int]time.Time{}}
+
+func (a *activeUsers) seen(userID int, now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.users[userID] = now
+}
+
+// Forgets the users not seen within the window and updates the gauge
+func (a *activeUsers) update(now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for id, last := range a.users {
+		if now.Sub(last) > activeUsersWindow {
+			delete(a.users, id)
+		}
+	}
+
+	activeUsersGauge.Set(float64(len(a.users)))
+}
+
+//
+// Health
+//
+
+// Unix time of the last successful getUpdates call
+var lastPoll int64
+
+func recordPoll(now time.Time) {
+	atomic.StoreInt64(&lastPoll, now.Unix())
+}
+
+// The bot is healthy when the database answers and the polling works. With
+// the webhook there's no polling, Telegram comes to us.
+func checkHealth(db *sqlitex.Pool, telegram TelegramConfig, now time.Time) error {
+	// Waits for a free connection only as long as the check may take
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), healthCheckTimeout)
+	defer cancel()
+
+	connection := db.Get(ctx)
+	if connection == nil {
+		return fmt.Errorf("database: no connection in %s", healthCheckTimeout)
+	}
+	defer db.Put(connection)
+
+	if err := sqlitex.Exec(connection, "SELECT 1;", nil); err != nil {
+		return fmt.Errorf("database: %v", err)
+	}
+
+	if telegram.Mode == pollingMode {
+		// A long poll lasts up to the timeout, give it some slack on top
+		limit := 2*time.Duration(telegram.PollTimeout)*time.Second + time.Minute
+		last := time.Unix(atomic.LoadInt64(&lastPoll), 0)
+		if now.Sub(last) > limit {
+			return fmt.Errorf("polling: the last successful poll was at %s", last.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+// Serves /metrics and /healthz in the background. The errors are only logged,
+// the bot works fine without the metrics.
+func serveMetrics(config Config, db *sqlitex.Pool) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := checkHealth(db, config.Telegram, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+
+	server := &http.Server{Addr: config.Metrics.Listen, Handler: mux}
+	go func() {
+		slog.Info("Serving the metrics", "address", config.Metrics.Listen)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Metrics server failed", "error", err)
+		}
+	}()
+
+	return server
+}
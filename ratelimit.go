@@ -0,0 +1,267 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	defaultRateLimitPerMinute = 30
+	defaultRateLimitBurst     = 10
+
+	// Telegram limits, see https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
+	globalSendRate  = 30
+	chatSendRate    = 1
+	groupSendRate   = 20.0 / 60
+	chatSendBurst   = 3
+	maxSendAttempts = 3
+
+	// Buckets idle for this long are full again, no need to keep them
+	idleBucketTimeout = 10 * time.Minute
+
+	slowDownMessage = "Whoa, slow down a bit! I'll skip your messages for a little while."
+)
+
+// tokenBucket holds up to `capacity` tokens, refilled at `rate` per second
+type tokenBucket struct {
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(capacity float64, rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{capacity: capacity, rate: rate, tokens: capacity, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+	}
+}
+
+// Takes a token if there's one
+func (b *tokenBucket) tryTake(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Takes a token even when there's none and returns how long to wait until
+// it would've been there. The waiting ones line up this way.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+//
+// Incoming
+//
+
+// rateLimiter limits the updates from every user separately
+type rateLimiter struct {
+	config RateLimitConfig
+	mutex  sync.Mutex
+	users  map[int]*userBucket
+}
+
+type userBucket struct {
+	bucket *tokenBucket
+	warned bool
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	return &rateLimiter{config: config, users: map[int]*userBucket{}}
+}
+
+// Returns whether the update from the user should be handled and whether the
+// user should be told to slow down. That's only done once until the user
+// gets through again.
+func (l *rateLimiter) allow(userID int, now time.Time) (bool, bool) {
+	if l.config.PerMinute <= 0 {
+		return true, false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	user, ok := l.users[userID]
+	if !ok {
+		bucket := newTokenBucket(float64(l.config.Burst), float64(l.config.PerMinute)/60, now)
+		user = &userBucket{bucket: bucket}
+		l.users[userID] = user
+	}
+
+	if user.bucket.tryTake(now) {
+		user.warned = false
+		return true, false
+	}
+
+	warn := !user.warned
+	user.warned = true
+
+	return false, warn
+}
+
+// Forgets the users who've been quiet for a while
+func (l *rateLimiter) prune(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for id, user := range l.users {
+		if now.Sub(user.bucket.last) > idleBucketTimeout {
+			delete(l.users, id)
+		}
+	}
+}
+
+//
+// Outgoing
+//
+
+// sender sends the messages slowly enough not to upset Telegram. It waits for
+// the global and the per chat limits and retries when Telegram asks to.
+type sender struct {
+	bot    *tgbotapi.BotAPI
+	mutex  sync.Mutex
+	global *tokenBucket
+	chats  map[int64]*tokenBucket
+
+	// Closed on shutdown, nobody waits anymore after that
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+func newSender(bot *tgbotapi.BotAPI) *sender {
+	return &sender{
+		bot:    bot,
+		global: newTokenBucket(globalSendRate, globalSendRate, time.Now()),
+		chats:  map[int64]*tokenBucket{},
+		quit:   make(chan struct{}),
+	}
+}
+
+// The waits block the workers. When the bot is shutting down, the replies that
+// are left go out right away and the ones Telegram rejects are not retried.
+// It's better than the workers running out of the shutdown time.
+func (s *sender) send(chatID int64, message tgbotapi.Chattable) (tgbotapi.Message, error) {
+	for attempt := 1; ; attempt++ {
+		s.wait(s.reserve(chatID, time.Now()))
+
+		sent, err := s.bot.Send(message)
+
+		seconds := retryAfter(err)
+		if seconds <= 0 || attempt >= maxSendAttempts || s.stopped() {
+			return sent, err
+		}
+
+		slog.Warn("Too many requests, retrying", "chat_id", chatID, "retry_after", seconds)
+		s.wait(time.Duration(seconds) * time.Second)
+	}
+}
+
+// The uploads fail with a plain error that only has the description
+var retryAfterDescription = regexp.MustCompile(`^Too Many Requests: retry after (\d+)`)
+
+// Returns how many seconds Telegram asks to wait before retrying or 0 when the
+// error is not about sending too much
+func retryAfter(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if apiErr, ok := err.(tgbotapi.Error); ok {
+		return apiErr.RetryAfter
+	}
+
+	match := retryAfterDescription.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0
+	}
+
+	seconds, _ := strconv.Atoi(match[1])
+	return seconds
+}
+
+// Stops the waiting, safe to call more than once
+func (s *sender) stop() {
+	s.stopOnce.Do(func() { close(s.quit) })
+}
+
+func (s *sender) stopped() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sleeps unless stopped
+func (s *sender) wait(duration time.Duration) {
+	if duration <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-s.quit:
+	}
+}
+
+// Returns how long to wait before sending to the chat
+func (s *sender) reserve(chatID int64, now time.Time) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	chat, ok := s.chats[chatID]
+	if !ok {
+		// The group chats have negative IDs and a lower limit
+		rate := float64(chatSendRate)
+		if chatID < 0 {
+			rate = groupSendRate
+		}
+
+		chat = newTokenBucket(chatSendBurst, rate, now)
+		s.chats[chatID] = chat
+	}
+
+	wait := chat.take(now)
+	if globalWait := s.global.take(now); globalWait > wait {
+		wait = globalWait
+	}
+
+	return wait
+}
+
+func (s *sender) prune(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, chat := range s.chats {
+		if now.Sub(chat.last) > idleBucketTimeout {
+			delete(s.chats, id)
+		}
+	}
+}
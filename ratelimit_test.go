@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestTokenBucketTryTake(t *testing.T) {
+	start := time.Unix(1000, 0)
+	bucket := newTokenBucket(3, 0.5, start)
+
+	tests := []struct {
+		after time.Duration
+		taken bool
+	}{
+		// The burst
+		{0, true},
+		{0, true},
+		{0, true},
+		{0, false},
+		// One token every 2 seconds
+		{time.Second, false},
+		{2 * time.Second, true},
+		{3 * time.Second, false},
+		// Never more than the capacity
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, false},
+		// The clock going back doesn't add anything
+		{time.Hour - time.Minute, false},
+	}
+
+	for i, test := range tests {
+		if taken := bucket.tryTake(start.Add(test.after)); taken != test.taken {
+			t.Errorf("%d at %s: got %v, want %v", i, test.after, taken, test.taken)
+		}
+	}
+}
+
+func TestTokenBucketTake(t *testing.T) {
+	start := time.Unix(1000, 0)
+	bucket := newTokenBucket(2, 4, start)
+
+	// The waiting ones line up a quarter of a second apart
+	want := []time.Duration{0, 0, 250 * time.Millisecond, 500 * time.Millisecond, 750 * time.Millisecond}
+	for i, w := range want {
+		if wait := bucket.take(start); wait != w {
+			t.Errorf("%d: got %s, want %s", i, wait, w)
+		}
+	}
+
+	// A second later the line is gone and there's a token again
+	if wait := bucket.take(start.Add(time.Second)); wait != 0 {
+		t.Errorf("got %s after the line is gone", wait)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(1000, 0)
+	limiter := newRateLimiter(RateLimitConfig{PerMinute: 60, Burst: 2})
+
+	tests := []struct {
+		user    int
+		after   time.Duration
+		allowed bool
+		warn    bool
+	}{
+		{1, 0, true, false},
+		{1, 0, true, false},
+		// Only warned once in a row
+		{1, 0, false, true},
+		{1, 0, false, false},
+		// The others are not affected
+		{2, 0, true, false},
+		// Warned again after getting through
+		{1, time.Second, true, false},
+		{1, time.Second, false, true},
+	}
+
+	for i, test := range tests {
+		allowed, warn := limiter.allow(test.user, start.Add(test.after))
+		if allowed != test.allowed || warn != test.warn {
+			t.Errorf("%d: got %v %v, want %v %v", i, allowed, warn, test.allowed, test.warn)
+		}
+	}
+
+	limiter.prune(start.Add(idleBucketTimeout + 2*time.Second))
+	if len(limiter.users) != 0 {
+		t.Errorf("got %d users after the pruning", len(limiter.users))
+	}
+
+	// Off
+	limiter = newRateLimiter(RateLimitConfig{})
+	for i := 0; i < 100; i++ {
+		if allowed, _ := limiter.allow(1, start); !allowed {
+			t.Fatal("nothing should be limited without the limit")
+		}
+	}
+}
+
+func TestSenderReserve(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := newSender(nil)
+	s.global = newTokenBucket(globalSendRate, globalSendRate, start)
+
+	// The chat burst first, then one a second for the users and one every 3
+	// seconds for the groups
+	tests := []struct {
+		chat int64
+		wait time.Duration
+	}{
+		{1, 0},
+		{1, 0},
+		{1, 0},
+		{1, time.Second},
+		{1, 2 * time.Second},
+		{-1, 0},
+		{-1, 0},
+		{-1, 0},
+		{-1, 3 * time.Second},
+	}
+
+	for i, test := range tests {
+		if wait := s.reserve(test.chat, start); wait != test.wait {
+			t.Errorf("%d: chat %d waits %s, want %s", i, test.chat, wait, test.wait)
+		}
+	}
+
+	// Doesn't wait once stopped
+	s.stop()
+	s.stop()
+	done := make(chan struct{})
+	go func() {
+		s.wait(time.Hour)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the stopped sender still waits")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{errors.New("connection reset by peer"), 0},
+		{tgbotapi.Error{Message: "Too Many Requests: retry after 5", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}, 5},
+		{tgbotapi.Error{Message: "Bad Request: chat not found"}, 0},
+		// What the uploads return
+		{errors.New("Too Many Requests: retry after 35"), 35},
+		{errors.New("Bad Request: Too Many Requests: retry after 35"), 0},
+	}
+
+	for _, test := range tests {
+		if got := retryAfter(test.err); got != test.want {
+			t.Errorf("%v: got %d, want %d", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// scheduler runs the background jobs periodically until stopped
+type scheduler struct {
+	quit chan struct{}
+	done sync.WaitGroup
+
+	// No new jobs once it's stopped
+	mutex   sync.Mutex
+	stopped bool
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{quit: make(chan struct{})}
+}
+
+// Runs the job every interval. A failed job is logged and retried at the next
+// tick, one bad run doesn't stop the schedule.
+func (s *scheduler) every(interval time.Duration, name string, job func() error) {
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := job(); err != nil {
+					slog.Error("Job failed", "job", name, "error", err)
+				}
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Runs the job once in the background, like a broadcast that takes a while.
+// The job should return soon after the quit channel is closed. Returns false
+// when the scheduler is stopped already and the job didn't start.
+func (s *scheduler) start(name string, job func(quit <-chan struct{}) error) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped {
+		return false
+	}
+
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+
+		if err := job(s.quit); err != nil {
+			slog.Error("Job failed", "job", name, "error", err)
+		}
+	}()
+
+	return true
+}
+
+// Stops scheduling new runs and waits for the running jobs to finish
+func (s *scheduler) stop() {
+	s.mutex.Lock()
+	s.stopped = true
+	close(s.quit)
+	s.mutex.Unlock()
+
+	s.done.Wait()
+}
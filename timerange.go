@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	secondsPerDay   = 24 * 60 * 60
+	rangeDateLayout = "2006-01-02"
+
+	// Nothing is logged before the unix time starts
+	minRangeYear = 1970
+)
+
+// timeRange is a half open [from, to) range of unix timestamps. The label is
+// used in the chart titles and responses, like "in the last 30 days". The days
+// of the range are the calendar days in the location, they are not always 24
+// hours long.
+type timeRange struct {
+	from     int64
+	to       int64
+	label    string
+	location *time.Location
+}
+
+var relativeRangeRegexp = regexp.MustCompile(`^(\d+)([dwmy])$`)
+var yearRangeRegexp = regexp.MustCompile(`^\d{4}$`)
+var monthRangeRegexp = regexp.MustCompile(`^\d{4}-\d{2}$`)
+var customRangeRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}\.\.\d{4}-\d{2}-\d{2}$`)
+
+func allTimeRange() timeRange {
+	return timeRange{from: 0, to: math.MaxInt64}
+}
+
+// The last n calendar days including today
+func lastDaysRange(now time.Time, n int) timeRange {
+	return timeRange{
+		from:     startOfDay(now).AddDate(0, 0, 1-n).Unix(),
+		to:       now.Unix() + 1,
+		label:    fmt.Sprintf("in the last %d days", n),
+		location: now.Location(),
+	}
+}
+
+// Parses the range argument. The supported formats are:
+//   - 30d, 12w, 6m, 1y - the days up to today, relative to now
+//   - 2024 - a calendar year
+//   - 2024-05 - a calendar month
+//   - 2026-01-01..2026-03-31 - a custom range, both ends inclusive
+//   - all - all time
+//
+// Returns false when the argument is not a range at all and an error when it
+// looks like one but doesn't work, like a year in the future. The end of the
+// range is never in the future.
+func parseTimeRange(arg string, now time.Time) (timeRange, bool, error) {
+	r, ok, err := parseTimeRangeUnclamped(strings.ToLower(arg), now)
+	if !ok || err != nil {
+		return r, ok, err
+	}
+
+	if limit := now.Unix() + 1; r.to > limit {
+		r.to = limit
+	}
+
+	if r.from >= r.to {
+		return r, true, fmt.Errorf("%s is in the future", arg)
+	}
+
+	return r, true, nil
+}
+
+func parseTimeRangeUnclamped(arg string, now time.Time) (timeRange, bool, error) {
+	location := now.Location()
+
+	if arg == "all" {
+		r := allTimeRange()
+		r.label = "of all time"
+		r.location = location
+		return r, true, nil
+	}
+
+	if m := relativeRangeRegexp.FindStringSubmatch(arg); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n <= 0 {
+			return timeRange{}, true, fmt.Errorf("%s is not a valid range, it should be at least 1%s", arg, m[2])
+		}
+
+		var from time.Time
+		var unit string
+		switch m[2] {
+		case "d":
+			return lastDaysRange(now, n), true, nil
+		case "w":
+			from, unit = now.AddDate(0, 0, -7*n), "weeks"
+		case "m":
+			from, unit = now.AddDate(0, -n, 0), "months"
+		case "y":
+			from, unit = now.AddDate(-n, 0, 0), "years"
+		}
+
+		// Starts on the day after, like the days do
+		return timeRange{
+			from:     startOfDay(from).AddDate(0, 0, 1).Unix(),
+			to:       now.Unix() + 1,
+			label:    fmt.Sprintf("in the last %d %s", n, unit),
+			location: location,
+		}, true, nil
+	}
+
+	if yearRangeRegexp.MatchString(arg) {
+		year, _ := strconv.Atoi(arg)
+		if year < minRangeYear || year > now.Year() {
+			return timeRange{}, true, fmt.Errorf("Please pick a year from %d to %d, %s is out of range", minRangeYear, now.Year(), arg)
+		}
+
+		start := time.Date(year, time.January, 1, 0, 0, 0, 0, location)
+		return timeRange{
+			from:     start.Unix(),
+			to:       start.AddDate(1, 0, 0).Unix(),
+			label:    "in " + arg,
+			location: location,
+		}, true, nil
+	}
+
+	if monthRangeRegexp.MatchString(arg) {
+		start, err := time.ParseInLocation("2006-01", arg, location)
+		if err != nil || start.Year() < minRangeYear {
+			return timeRange{}, true, fmt.Errorf("%s is not a valid month, it should look like 2024-05", arg)
+		}
+
+		return timeRange{
+			from:     start.Unix(),
+			to:       start.AddDate(0, 1, 0).Unix(),
+			label:    "in " + start.Format("January 2006"),
+			location: location,
+		}, true, nil
+	}
+
+	if customRangeRegexp.MatchString(arg) {
+		parts := strings.Split(arg, "..")
+		invalid := fmt.Errorf("%s is not a valid range, it should look like 2026-01-01..2026-03-31", arg)
+
+		start, err := time.ParseInLocation(rangeDateLayout, parts[0], location)
+		if err != nil || start.Year() < minRangeYear {
+			return timeRange{}, true, invalid
+		}
+
+		end, err := time.ParseInLocation(rangeDateLayout, parts[1], location)
+		if err != nil {
+			return timeRange{}, true, invalid
+		}
+
+		if end.Before(start) {
+			return timeRange{}, true, fmt.Errorf("%s ends before it starts", arg)
+		}
+
+		return timeRange{
+			from:     start.Unix(),
+			to:       end.AddDate(0, 0, 1).Unix(),
+			label:    fmt.Sprintf("from %s to %s", parts[0], parts[1]),
+			location: location,
+		}, true, nil
+	}
+
+	return timeRange{}, false, nil
+}
+
+// Splits "name range" into the name and the range. When the last word is not
+// a range the whole string is the name and the default range is used.
+func splitNameAndRange(args string, now time.Time, defaultRange timeRange) (string, timeRange, error) {
+	args = strings.TrimSpace(args)
+
+	i := strings.LastIndexAny(args, " \t")
+	if i < 0 {
+		return args, defaultRange, nil
+	}
+
+	r, ok, err := parseTimeRange(args[i+1:], now)
+	if !ok || err != nil {
+		return args, defaultRange, err
+	}
+
+	return strings.TrimSpace(args[:i]), r, nil
+}
+
+// Number of the calendar days in the range, a partial day counts as a full one
+func (r timeRange) numDays() int {
+	// There's no last day to count from
+	if r.to == math.MaxInt64 {
+		return math.MaxInt32
+	}
+
+	return r.dayIndex(r.from) + 1
+}
+
+// How many calendar days the day of the date is before the last day of the
+// range. 0 is the last day.
+func (r timeRange) dayIndex(date int64) int {
+	return int(r.dayNumber(r.to-1) - r.dayNumber(date))
+}
+
+// The start of the calendar day that is `index` days before the last day of
+// the range. The dates on the chart axes come from here, so they match the
+// days the events are counted in.
+func (r timeRange) dayStart(index int) time.Time {
+	return startOfDay(time.Unix(r.to-1, 0).In(r.zone())).AddDate(0, 0, -index)
+}
+
+// Days since the unix epoch by the calendar of the location
+func (r timeRange) dayNumber(date int64) int64 {
+	year, month, day := time.Unix(date, 0).In(r.zone()).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / secondsPerDay
+}
+
+// The location of the days, UTC when the range doesn't have one
+func (r timeRange) zone() *time.Location {
+	if r.location == nil {
+		return time.UTC
+	}
+
+	return r.location
+}
+
+// Appends the range label to a title or a message
+func (r timeRange) describe(text string) string {
+	if r.label == "" {
+		return text
+	}
+	return text + " " + r.label
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
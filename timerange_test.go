@@ -0,0 +1,180 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return location
+}
+
+func TestParseTimeRange(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	now := time.Date(2026, time.October, 18, 12, 0, 0, 0, berlin)
+	date := func(year int, month time.Month, day int) int64 {
+		return time.Date(year, month, day, 0, 0, 0, 0, berlin).Unix()
+	}
+
+	tests := []struct {
+		arg     string
+		isRange bool
+		fails   bool
+		from    int64
+		to      int64
+		days    int
+	}{
+		{arg: "coffee"},
+		{arg: "12"},
+		{arg: "30d", isRange: true, from: date(2026, time.September, 19), to: now.Unix() + 1, days: 30},
+		{arg: "1d", isRange: true, from: date(2026, time.October, 18), to: now.Unix() + 1, days: 1},
+		{arg: "0d", isRange: true, fails: true},
+		{arg: "2w", isRange: true, from: date(2026, time.October, 5), to: now.Unix() + 1, days: 14},
+		{arg: "1m", isRange: true, from: date(2026, time.September, 19), to: now.Unix() + 1, days: 30},
+		{arg: "2024", isRange: true, from: date(2024, time.January, 1), to: date(2025, time.January, 1), days: 366},
+		{arg: "2026", isRange: true, from: date(2026, time.January, 1), to: now.Unix() + 1, days: 291},
+		{arg: "2030", isRange: true, fails: true},
+		{arg: "1969", isRange: true, fails: true},
+		{arg: "2024-02", isRange: true, from: date(2024, time.February, 1), to: date(2024, time.March, 1), days: 29},
+		{arg: "2024-13", isRange: true, fails: true},
+		{arg: "2026-11", isRange: true, fails: true},
+		{arg: "2026-01-01..2026-03-31", isRange: true, from: date(2026, time.January, 1), to: date(2026, time.April, 1), days: 90},
+		{arg: "2026-03-31..2026-01-01", isRange: true, fails: true},
+		{arg: "2026-02-30..2026-03-31", isRange: true, fails: true},
+		{arg: "2027-01-01..2027-01-31", isRange: true, fails: true},
+		{arg: "all", isRange: true, from: 0, to: now.Unix() + 1},
+		{arg: "ALL", isRange: true, from: 0, to: now.Unix() + 1},
+	}
+
+	for _, test := range tests {
+		r, isRange, err := parseTimeRange(test.arg, now)
+		if isRange != test.isRange || (err != nil) != test.fails {
+			t.Errorf("%s: got range %v and error %v", test.arg, isRange, err)
+			continue
+		}
+
+		if !isRange || test.fails {
+			continue
+		}
+
+		if r.from != test.from || r.to != test.to {
+			t.Errorf("%s: got [%d, %d), want [%d, %d)", test.arg, r.from, r.to, test.from, test.to)
+		}
+
+		if test.days != 0 && r.numDays() != test.days {
+			t.Errorf("%s: got %d days, want %d", test.arg, r.numDays(), test.days)
+		}
+	}
+}
+
+// The days around the daylight saving time changes are 23 and 25 hours long
+func TestTimeRangeCalendarDays(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+
+	tests := []struct {
+		now  time.Time
+		days int
+		from time.Time
+	}{
+		// Spring forward on March 29
+		{time.Date(2026, time.March, 30, 10, 0, 0, 0, berlin), 3, time.Date(2026, time.March, 28, 0, 0, 0, 0, berlin)},
+		// Fall back on October 25
+		{time.Date(2026, time.October, 26, 0, 30, 0, 0, berlin), 3, time.Date(2026, time.October, 24, 0, 0, 0, 0, berlin)},
+	}
+
+	for _, test := range tests {
+		r := lastDaysRange(test.now, test.days)
+		if r.from != test.from.Unix() {
+			t.Errorf("%s: starts at %s, want %s", test.now, time.Unix(r.from, 0).In(berlin), test.from)
+		}
+
+		if r.numDays() != test.days {
+			t.Errorf("%s: got %d days, want %d", test.now, r.numDays(), test.days)
+		}
+
+		// Every hour of the range falls on the right day, all of them are in
+		// the same month
+		for date := r.from; date < r.to; date += 60 * 60 {
+			want := test.days - 1 - (time.Unix(date, 0).In(berlin).Day() - test.from.Day())
+			if got := r.dayIndex(date); got != want {
+				t.Errorf("%s: day %d, want %d", time.Unix(date, 0).In(berlin), got, want)
+			}
+
+			// The axis labels are on the same days
+			if start := r.dayStart(want); !start.Equal(startOfDay(time.Unix(date, 0).In(berlin))) {
+				t.Errorf("%s: day %d starts at %s", time.Unix(date, 0).In(berlin), want, start)
+			}
+		}
+	}
+}
+
+func TestSplitNameAndRange(t *testing.T) {
+	now := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	defaultRange := lastDaysRange(now, 30)
+
+	tests := []struct {
+		args  string
+		name  string
+		label string
+		fails bool
+	}{
+		{"coffee", "coffee", "in the last 30 days", false},
+		{"green tea", "green tea", "in the last 30 days", false},
+		{"green tea 90d", "green tea", "in the last 90 days", false},
+		{"run 2024", "run", "in 2024", false},
+		{"run 2030", "", "", true},
+		{"  run   2024-05 ", "run", "in May 2024", false},
+		{"", "", "in the last 30 days", false},
+	}
+
+	for _, test := range tests {
+		name, r, err := splitNameAndRange(test.args, now, defaultRange)
+		if (err != nil) != test.fails {
+			t.Errorf("'%s': got error %v", test.args, err)
+			continue
+		}
+
+		if !test.fails && (name != test.name || r.label != test.label) {
+			t.Errorf("'%s': got '%s' %s, want '%s' %s", test.args, name, r.label, test.name, test.label)
+		}
+	}
+}
+
+func TestParseTopArgs(t *testing.T) {
+	now := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	charts := defaultConfig().Charts
+
+	tests := []struct {
+		args  string
+		num   int
+		label string
+		fails bool
+	}{
+		{"", defaultTopCount, "", false},
+		{"5", 5, "", false},
+		{"1", minTopCount, "", false},
+		{"2024", maxTopCount, "", false},
+		{"10 2025", 10, "in 2025", false},
+		{"2025-01", defaultTopCount, "in January 2025", false},
+		{"5 2026-01-01..2026-03-31", 5, "from 2026-01-01 to 2026-03-31", false},
+		{"10 2030", 0, "", true},
+	}
+
+	for _, test := range tests {
+		num, r, err := parseTopArgs(test.args, now, charts)
+		if (err != nil) != test.fails {
+			t.Errorf("'%s': got error %v", test.args, err)
+			continue
+		}
+
+		if !test.fails && (num != test.num || r.label != test.label) {
+			t.Errorf("'%s': got %d %s, want %d %s", test.args, num, r.label, test.num, test.label)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// A shared tracker is an event name a few users log to together. The events
+// in it belong to the tracker and not to any of the users, the author says
+// who logged it. Everyone sees the tracker events next to their own, under
+// the same name.
+
+const (
+	ownerRole  = "owner"
+	memberRole = "member"
+	viewerRole = "viewer"
+
+	// The invites go through the /start links, like the access invites
+	shareCodePrefix = "share_"
+	shareCodeBytes  = 8
+
+	readOnlyMessage = "You can only look at '%s', ask the owner to make you a member to log it"
+)
+
+// The events the user can see, their own and the ones in the trackers they
+// are in. Must go first in the WHERE, it takes the user as the first argument
+// and the plain ? after it continue from the second.
+const visibleEvents = "(user = ?1 OR tracker IN (SELECT tracker FROM tracker_members WHERE user = ?1))"
+
+// The tracker the user has with the name and the user's role in it. Returns 0
+// when there's none and the events are the user's own.
+func findTracker(connection *sqlite.Conn, userID int, name string) (int64, string, error) {
+	var tracker int64
+	role := ""
+	err := sqlitex.Exec(
+		connection,
+		"SELECT trackers.id, tracker_members.role FROM trackers "+
+			"JOIN tracker_members ON tracker_members.tracker = trackers.id "+
+			"WHERE tracker_members.user = ? AND trackers.name_hash = name_hash(?);",
+		func(s *sqlite.Stmt) error {
+			tracker = s.ColumnInt64(0)
+			role = s.ColumnText(1)
+			return nil
+		},
+		userID,
+		name)
+
+	return tracker, role, err
+}
+
+// Whether the user is only a viewer of the tracker with the name
+func isReadOnly(connection *sqlite.Conn, userID int, name string) (bool, error) {
+	_, role, err := findTracker(connection, userID, name)
+	return role == viewerRole, err
+}
+
+// "baby feeding viewer" -> "baby feeding", "viewer"
+func parseShareArgs(args string) (string, string) {
+	words := strings.Fields(args)
+	if len(words) > 1 {
+		last := strings.ToLower(words[len(words)-1])
+		if last == memberRole || last == viewerRole {
+			return strings.Join(words[:len(words)-1], " "), last
+		}
+	}
+
+	return strings.TrimSpace(args), memberRole
+}
+
+// Makes the event a shared tracker on the first go and sends a link to join it
+func (c context) share(args string) error {
+	name, role := parseShareArgs(args)
+	if name == "" {
+		return c.sendMarkdown("Please provide a name: /share *name* *[member|viewer]*")
+	}
+
+	// In a shared group everyone is in already
+	if c.owner != c.message.From.ID {
+		return c.sendText("Please share it from the private chat with me")
+	}
+
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	tracker, myRole, err := findTracker(connection, c.owner, name)
+	if err != nil {
+		return err
+	}
+
+	if tracker != 0 && myRole != ownerRole {
+		return c.sendText(fmt.Sprintf("Only the owner of '%s' can invite others", name))
+	}
+
+	buffer := make([]byte, shareCodeBytes)
+	if _, err := rand.Read(buffer); err != nil {
+		return err
+	}
+
+	code := shareCodePrefix + hex.EncodeToString(buffer)
+
+	err = c.createShareInvite(connection, tracker, name, role, code)
+	if err != nil {
+		return err
+	}
+
+	c.logger().Info("Tracker invite created", "name", redact(name), "role", role)
+
+	response := fmt.Sprintf("Send this to whoever should join '%s' as a %s, it works once:\n/start %s", name, role, code)
+	if c.bot != nil {
+		response = fmt.Sprintf("Send this link to whoever should join '%s' as a %s, it works once:\nhttps://t.me/%s?start=%s", name, role, c.bot.Self.UserName, code)
+	}
+
+	return c.sendText(response)
+}
+
+// Creates the tracker when there's none yet. The user's events with the name
+// move into it, so the others see the whole history.
+func (c context) createShareInvite(connection *sqlite.Conn, tracker int64, name string, role string, code string) (err error) {
+	defer sqlitex.Save(connection)(&err)
+
+	now := c.now().Unix()
+
+	if tracker == 0 {
+		err = sqlitex.Exec(
+			connection,
+			"INSERT INTO trackers (name, name_hash, date) VALUES (encrypt_name(?1), name_hash(?1), ?2);",
+			nil,
+			name,
+			now)
+
+		if err != nil {
+			return err
+		}
+
+		tracker = connection.LastInsertRowID()
+
+		err = sqlitex.Exec(
+			connection,
+			"INSERT INTO tracker_members (tracker, user, role, date) VALUES (?, ?, ?, ?);",
+			nil,
+			tracker,
+			c.owner,
+			ownerRole,
+			now)
+
+		if err != nil {
+			return err
+		}
+
+		err = sqlitex.Exec(
+			connection,
+			"UPDATE events SET tracker = ?, author = COALESCE(author, user), user = NULL "+
+				"WHERE user = ? AND name_hash = name_hash(?);",
+			nil,
+			tracker,
+			c.owner,
+			name)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return sqlitex.Exec(
+		connection,
+		"INSERT INTO tracker_invites (code, tracker, role, owner, date) VALUES (?, ?, ?, ?, ?);",
+		nil,
+		code,
+		tracker,
+		role,
+		c.owner,
+		now)
+}
+
+// "/start share_..." from the invite link
+func (c context) joinTracker(code string) error {
+	connection := getConnection(c.db)
+	defer c.db.Put(connection)
+
+	name, role, err := joinTracker(connection, code, c.message.From.ID, c.now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		return c.sendText("This invite doesn't work. It's been used already, or you share another event with the same name. Please ask for a new one.")
+	}
+
+	c.logger().Info("User joined a tracker", "name", redact(name), "role", role)
+
+	if role == viewerRole {
+		return c.sendText(fmt.Sprintf("You can see '%s' now, try /since %s", name, name))
+	}
+
+	return c.sendText(fmt.Sprintf("You're in '%s' now, send %s to log it for everyone", name, name))
+}
+
+// Uses up the invite and adds the user to the tracker. Returns the tracker
+// name and the role, or "" when the invite doesn't work. A user can't have
+// two trackers with the same name.
+func joinTracker(connection *sqlite.Conn, code string, userID int, now int64) (name string, role string, err error) {
+	defer sqlitex.Save(connection)(&err)
+
+	var tracker int64
+	err = sqlitex.Exec(
+		connection,
+		"SELECT trackers.id, decrypt_name(trackers.name), tracker_invites.role FROM tracker_invites "+
+			"JOIN trackers ON trackers.id = tracker_invites.tracker "+
+			"WHERE tracker_invites.code = ? AND tracker_invites.user IS NULL;",
+		func(s *sqlite.Stmt) error {
+			tracker = s.ColumnInt64(0)
+			name = s.ColumnText(1)
+			role = s.ColumnText(2)
+			return nil
+		},
+		code)
+
+	if err != nil || tracker == 0 {
+		return "", "", err
+	}
+
+	existing, existingRole, err := findTracker(connection, userID, name)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch {
+	case existing == tracker:
+		// Joined already, the owner stays the owner
+		return name, existingRole, nil
+	case existing != 0:
+		return "", "", nil
+	}
+
+	err = sqlitex.Exec(
+		connection,
+		"UPDATE tracker_invites SET user = ? WHERE code = ?;",
+		nil,
+		userID,
+		code)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	err = sqlitex.Exec(
+		connection,
+		"INSERT INTO tracker_members (tracker, user, role, date) VALUES (?, ?, ?, ?);",
+		nil,
+		tracker,
+		userID,
+		role,
+		now)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	return name, role, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestParseShareArgs(t *testing.T) {
+	tests := []struct {
+		args string
+		name string
+		role string
+	}{
+		{"coffee", "coffee", memberRole},
+		{"baby feeding", "baby feeding", memberRole},
+		{"baby feeding viewer", "baby feeding", viewerRole},
+		{"baby feeding Member", "baby feeding", memberRole},
+		{"  walk  ", "walk", memberRole},
+		// A name on its own is never a role
+		{"viewer", "viewer", memberRole},
+		{"", "", memberRole},
+		// The owner is not given away with a link
+		{"walk owner", "walk owner", memberRole},
+	}
+
+	for _, test := range tests {
+		name, role := parseShareArgs(test.args)
+		if name != test.name || role != test.role {
+			t.Errorf("'%s': got '%s' %s, want '%s' %s", test.args, name, role, test.name, test.role)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+const (
+	offsetSaveInterval = time.Minute
+
+	updateOffsetKey = "update_offset"
+)
+
+// Returns the offset saved by the previous run or 0 when there's none. 0 makes
+// Telegram send everything it still has.
+func loadUpdateOffset(db *sqlitex.Pool) (int, error) {
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	offset, err := getState(connection, updateOffsetKey)
+	return int(offset), err
+}
+
+// Stores the offset of the first update that is not processed yet. The ones
+// before it are done and should not be requested from Telegram again. The
+// processed IDs below the offset are not needed anymore either.
+func saveUpdateOffset(db *sqlitex.Pool, offset int) (err error) {
+	// Nothing has been processed yet
+	if offset == 0 {
+		return nil
+	}
+
+	connection := getConnection(db)
+	defer db.Put(connection)
+
+	defer sqlitex.Save(connection)(&err)
+
+	err = setState(connection, updateOffsetKey, int64(offset))
+	if err != nil {
+		return err
+	}
+
+	return sqlitex.Exec(connection, "DELETE FROM updates WHERE id < ?;", nil, offset)
+}
+
+func getState(connection *sqlite.Conn, key string) (int64, error) {
+	var value int64
+	err := sqlitex.Exec(
+		connection,
+		"SELECT value FROM state WHERE key = ?;",
+		func(s *sqlite.Stmt) error {
+			value = s.ColumnInt64(0)
+			return nil
+		},
+		key)
+
+	return value, err
+}
+
+func setState(connection *sqlite.Conn, key string, value int64) error {
+	return sqlitex.Exec(
+		connection,
+		"INSERT OR REPLACE INTO state (key, value) VALUES (?, ?);",
+		nil,
+		key,
+		value)
+}
+
+// Checks if the update has been handled already. Telegram sends the updates
+// again when the offset didn't make it to the DB before the bot went down.
+func isUpdateProcessed(connection *sqlite.Conn, updateID int) (bool, error) {
+	processed := false
+	err := sqlitex.Exec(
+		connection,
+		"SELECT 1 FROM updates WHERE id = ?;",
+		func(s *sqlite.Stmt) error {
+			processed = true
+			return nil
+		},
+		updateID)
+
+	return processed, err
+}
+
+// Returns false when the update has been marked already
+func markUpdateProcessed(connection *sqlite.Conn, updateID int, now int64) (bool, error) {
+	err := sqlitex.Exec(
+		connection,
+		"INSERT OR IGNORE INTO updates (id, date) VALUES (?, ?);",
+		nil,
+		updateID,
+		now)
+
+	if err != nil {
+		return false, err
+	}
+
+	return connection.Changes() > 0, nil
+}